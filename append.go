@@ -0,0 +1,103 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrUnexpectedRemoteSize is returned by `AppendToRemote` when the size of the remote file
+// does not match the offset the reader resumes from.
+var ErrUnexpectedRemoteSize = errors.New("remote file does not have the expected size")
+
+// AppendToRemote appends exactly `size` bytes from the reader to the existing remote file at
+// `remotePath`, for example to resume an interrupted upload by sending only the missing tail.
+// The caller is responsible for positioning the reader at the offset to resume from.
+//
+// As scp can only replace files, the bytes are appended by running `tee -a` on the remote,
+// which requires a remote shell. When the remote scp binary is run through a wrapper such
+// as "sudo scp", `tee` is run through the same wrapper, so the file is opened with the
+// privileges of the wrapper rather than those of the login shell.
+//
+// The remote file is checked with `StatRemote` first. If the reader implements io.Seeker,
+// ErrUnexpectedRemoteSize is returned when the size of the remote file is not the current
+// offset of the reader, so no bytes are appended to a file that is longer or shorter than
+// the prefix that was already sent. ErrShortRead is returned if the reader runs out before
+// `size` bytes were read, the bytes read until then have been appended.
+func (a *Client) AppendToRemote(ctx context.Context, r io.Reader, remotePath string, size int64, opts ...CallOption) error {
+	remotePath, err := a.expandTilde(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+
+	if err := a.checkRemotePath(remotePath); err != nil {
+		return err
+	}
+
+	if err := a.checkNotSymlinks(ctx, remotePath); err != nil {
+		return err
+	}
+
+	info, err := a.StatRemote(ctx, remotePath, opts...)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return ErrIsDirectory
+	}
+
+	if seeker, ok := r.(io.Seeker); ok {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if info.Size != offset {
+			return fmt.Errorf("%w: %q has %d bytes, resuming from offset %d", ErrUnexpectedRemoteSize, remotePath, info.Size, offset)
+		}
+	}
+
+	if a.DryRun {
+		return nil
+	}
+
+	command := fmt.Sprintf("%stee -a -- %s >/dev/null", a.callOptions(opts).commandPrefix(), quoteShell(remotePath))
+	_, err = a.runRemoteInput(ctx, command, &exactReader{r: contextReader{ctx: ctx, r: r}, size: size})
+	if err != nil {
+		return fmt.Errorf("failed to append to %q: %w", remotePath, err)
+	}
+	return nil
+}
+
+// exactReader yields exactly `size` bytes from the wrapped reader, returning ErrShortRead
+// if it ends before that.
+type exactReader struct {
+	r    io.Reader
+	size int64
+	n    int64
+}
+
+func (r *exactReader) Read(p []byte) (int, error) {
+	if r.n >= r.size {
+		return 0, io.EOF
+	}
+	if remaining := r.size - r.n; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err == io.EOF && r.n < r.size {
+		return n, fmt.Errorf("%w: expected %d bytes, sent %d", ErrShortRead, r.size, r.n)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
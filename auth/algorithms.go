@@ -0,0 +1,57 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package auth
+
+import "golang.org/x/crypto/ssh"
+
+// LegacyCiphers the ciphers offered by `WithLegacyAlgorithms`: the secure defaults, followed by
+// the CBC and arcfour ciphers still required by old network equipment.
+var LegacyCiphers = []string{
+	"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+	"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+}
+
+// LegacyKeyExchanges the key exchange algorithms offered by `WithLegacyAlgorithms`: the secure
+// defaults, followed by the SHA-1 based Diffie-Hellman exchanges of old network equipment.
+var LegacyKeyExchanges = []string{
+	"curve25519-sha256", "curve25519-sha256@libssh.org",
+	"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+	"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+	"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+}
+
+// LegacyMACs the MAC algorithms offered by `WithLegacyAlgorithms`: the secure defaults,
+// followed by the truncated SHA-1 MAC of old network equipment.
+var LegacyMACs = []string{
+	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+	"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
+}
+
+// WithAlgorithms returns a copy of the configuration that offers the given ciphers, key exchange
+// algorithms and MAC algorithms to the server, in order of preference. A nil list leaves the
+// algorithms of that kind at the defaults of golang.org/x/crypto/ssh.
+func WithAlgorithms(config ssh.ClientConfig, ciphers, keyExchanges, macs []string) ssh.ClientConfig {
+	if ciphers != nil {
+		config.Ciphers = ciphers
+	}
+	if keyExchanges != nil {
+		config.KeyExchanges = keyExchanges
+	}
+	if macs != nil {
+		config.MACs = macs
+	}
+	return config
+}
+
+// WithLegacyAlgorithms returns a copy of the configuration that also offers the insecure
+// algorithms needed to connect to old network equipment, such as switches and routers.
+// The secure algorithms are still preferred when the server supports them.
+func WithLegacyAlgorithms(config ssh.ClientConfig) ssh.ClientConfig {
+	return WithAlgorithms(config, LegacyCiphers, LegacyKeyExchanges, LegacyMACs)
+}
@@ -6,6 +6,10 @@
 package auth
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -14,6 +18,12 @@ import (
 	"golang.org/x/crypto/ssh/agent"
 )
 
+// ErrNoAgent is returned when no SSH agent is available because SSH_AUTH_SOCK is not set.
+var ErrNoAgent = errors.New("no ssh agent available: SSH_AUTH_SOCK is not set")
+
+// ErrNoPrivateKey is returned by `PrivateKeys` when none of the private keys could be loaded.
+var ErrNoPrivateKey = errors.New("none of the private keys could be loaded")
+
 // PrivateKey Loads a private and public key from "path" and returns a SSH ClientConfig to authenticate with the server
 func PrivateKey(username string, path string, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfig, error) {
 	privateKey, err := ioutil.ReadFile(path)
@@ -22,7 +32,13 @@ func PrivateKey(username string, path string, keyCallBack ssh.HostKeyCallback) (
 		return ssh.ClientConfig{}, err
 	}
 
-	signer, err := ssh.ParsePrivateKey(privateKey)
+	return PrivateKeyBytes(username, privateKey, keyCallBack)
+}
+
+// PrivateKeyBytes creates a configuration like `PrivateKey`, but parses the PEM encoded private key
+// from memory, for keys that come from a secrets manager or are embedded in the program.
+func PrivateKeyBytes(username string, pem []byte, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfig, error) {
+	signer, err := ssh.ParsePrivateKey(pem)
 
 	if err != nil {
 		return ssh.ClientConfig{}, err
@@ -37,6 +53,50 @@ func PrivateKey(username string, path string, keyCallBack ssh.HostKeyCallback) (
 	}, nil
 }
 
+// PrivateKeys creates a configuration like `PrivateKey`, but loads all the private keys at the given
+// paths, which the server is offered in order, for when it is not known which of them it accepts.
+// Keys that can not be read or parsed are skipped, as long as at least one key was loaded, use
+// `PrivateKeysWithWarnings` to find out which. ErrNoPrivateKey is returned if no key was loaded.
+func PrivateKeys(username string, paths []string, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfig, error) {
+	config, _, err := PrivateKeysWithWarnings(username, paths, keyCallBack)
+	return config, err
+}
+
+// PrivateKeysWithWarnings creates a configuration like `PrivateKeys`, and also returns an error for
+// every key that was skipped because it could not be read or parsed, naming its path. Keys protected
+// by a passphrase are skipped as well.
+func PrivateKeysWithWarnings(username string, paths []string, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfig, []error, error) {
+	var signers []ssh.Signer
+	var warnings []error
+	for _, path := range paths {
+		privateKey, err := ioutil.ReadFile(path)
+		if err == nil {
+			var signer ssh.Signer
+			signer, err = ssh.ParsePrivateKey(privateKey)
+			if err == nil {
+				signers = append(signers, signer)
+				continue
+			}
+		}
+		warnings = append(warnings, fmt.Errorf("skipped private key %q: %w", path, err))
+	}
+
+	if len(signers) == 0 {
+		if len(warnings) == 0 {
+			return ssh.ClientConfig{}, nil, ErrNoPrivateKey
+		}
+		return ssh.ClientConfig{}, warnings, fmt.Errorf("%w: %w", ErrNoPrivateKey, errors.Join(warnings...))
+	}
+
+	return ssh.ClientConfig{
+		User: username,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signers...),
+		},
+		HostKeyCallback: keyCallBack,
+	}, warnings, nil
+}
+
 // Creates the configuration for a client that authenticates with a password protected private key
 func PrivateKeyWithPassphrase(username string, passpharase []byte, path string, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfig, error) {
 	privateKey, err := ioutil.ReadFile(path)
@@ -44,7 +104,14 @@ func PrivateKeyWithPassphrase(username string, passpharase []byte, path string,
 	if err != nil {
 		return ssh.ClientConfig{}, err
 	}
-	signer, err := ssh.ParsePrivateKeyWithPassphrase(privateKey, passpharase)
+
+	return PrivateKeyWithPassphraseBytes(username, passpharase, privateKey, keyCallBack)
+}
+
+// PrivateKeyWithPassphraseBytes creates a configuration like `PrivateKeyWithPassphrase`, but parses
+// the PEM encoded private key from memory.
+func PrivateKeyWithPassphraseBytes(username string, passphrase []byte, pem []byte, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfig, error) {
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
 
 	if err != nil {
 		return ssh.ClientConfig{}, err
@@ -60,11 +127,34 @@ func PrivateKeyWithPassphrase(username string, passpharase []byte, path string,
 }
 
 // Creates a configuration for a client that fetches public-private key from the SSH agent for authentication
+//
+// The connection to the agent stays open for as long as the program runs, as the configuration
+// uses it whenever a connection is made. Use `SshAgentWithCloser` to be able to close it.
 func SshAgent(username string, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfig, error) {
+	return SshAgentContext(context.Background(), username, keyCallBack)
+}
+
+// SshAgentContext creates a configuration like `SshAgent`, but gives up connecting to the SSH agent
+// as soon as the context is done. ErrNoAgent is returned if SSH_AUTH_SOCK is not set.
+func SshAgentContext(ctx context.Context, username string, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfig, error) {
+	config, _, err := SshAgentWithCloser(ctx, username, keyCallBack)
+	return config, err
+}
+
+// SshAgentWithCloser creates a configuration like `SshAgentContext`, and returns the connection to
+// the SSH agent it uses. The caller owns the connection and must close it once no more connections
+// are made with the configuration, an established SSH connection does not need it anymore.
+// Long running programs that create many configurations should use this to not leak connections.
+func SshAgentWithCloser(ctx context.Context, username string, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfig, io.Closer, error) {
 	socket := os.Getenv("SSH_AUTH_SOCK")
-	conn, err := net.Dial("unix", socket)
+	if socket == "" {
+		return ssh.ClientConfig{}, nil, ErrNoAgent
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socket)
 	if err != nil {
-		return ssh.ClientConfig{}, err
+		return ssh.ClientConfig{}, nil, err
 	}
 
 	agentClient := agent.NewClient(conn)
@@ -74,7 +164,7 @@ func SshAgent(username string, keyCallBack ssh.HostKeyCallback) (ssh.ClientConfi
 			ssh.PublicKeysCallback(agentClient.Signers),
 		},
 		HostKeyCallback: keyCallBack,
-	}, nil
+	}, conn, nil
 }
 
 // Creates a configuration for a client that authenticates using username and password
@@ -0,0 +1,79 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CopyBetween copies the remote file at `srcPath` on `src` to `dstPath` on `dst`, like
+// `scp -3`. The file is streamed from the download straight into the upload, both running at
+// the same time, so it is never stored locally. When `permissions` is empty, the permissions
+// of the source file are used.
+//
+// If the upload fails, the download is aborted and the error of the upload is returned. If
+// the source reports an error after sending the contents, that error is returned, and the
+// copy on the destination can not be trusted.
+//
+// When `src` and `dst` are the same client, or copies of it, and `MaxConcurrentSessions` only
+// allows a single session, the download and the upload can not run at the same time. The file
+// is then downloaded to a temporary local file first, and uploaded once it was received.
+func CopyBetween(ctx context.Context, src *Client, srcPath string, dst *Client, dstPath, permissions string) error {
+	// The upload opens its session while the download holds one
+	if src.sessions != nil && src.sessions == dst.sessions && dst.MaxConcurrentSessions == 1 {
+		return copyBetweenStaged(ctx, src, srcPath, dst, dstPath, permissions)
+	}
+
+	r, info, err := src.OpenRemote(ctx, srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %q on the source: %w", srcPath, err)
+	}
+
+	if permissions == "" {
+		permissions = fmt.Sprintf("%04o", info.Permissions&07777)
+	}
+
+	err = dst.CopyN(ctx, r, dstPath, permissions, info.Size)
+	if closeErr := r.Close(); closeErr != nil && err == nil {
+		return fmt.Errorf("failed to read %q from the source: %w", srcPath, closeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy %q to the destination: %w", dstPath, err)
+	}
+	return nil
+}
+
+// copyBetweenStaged copies the file like `CopyBetween`, downloading it to a temporary local
+// file before uploading it, so only one session is open at a time.
+func copyBetweenStaged(ctx context.Context, src *Client, srcPath string, dst *Client, dstPath, permissions string) error {
+	f, err := os.CreateTemp("", "go-scp-between-*")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file for %q: %w", srcPath, err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	info, err := src.CopyFromRemoteFileInfos(ctx, f, srcPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read %q from the source: %w", srcPath, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if permissions == "" {
+		permissions = fmt.Sprintf("%04o", info.Permissions&07777)
+	}
+
+	if err := dst.CopyN(ctx, f, dstPath, permissions, info.Size); err != nil {
+		return fmt.Errorf("failed to copy %q to the destination: %w", dstPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Chmod changes the permissions of the remote file or directory at `remotePath` by running
+// `chmod` on the remote, without transferring it again. Like the permissions of uploads,
+// `perm` is restricted by `PermissionMask`. A RemoteError holding the output of `chmod` is
+// returned if it fails.
+//
+// When the remote scp binary is run through a wrapper such as "sudo scp", `chmod` is run
+// through the same wrapper.
+func (a *Client) Chmod(ctx context.Context, remotePath string, perm os.FileMode, opts ...CallOption) error {
+	remotePath, err := a.expandTilde(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+
+	if err := a.checkRemotePath(remotePath); err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf(
+		"%schmod %s -- %s",
+		a.callOptions(opts).commandPrefix(),
+		formatPermissions(a.maskPermissions(perm)),
+		quoteShell(remotePath),
+	)
+	_, err = a.runRemote(ctx, command)
+	return err
+}
@@ -9,27 +9,95 @@ package scp
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// ErrIsDirectory is returned when downloading a single file from a remote path that is a directory.
+var ErrIsDirectory = errors.New("remote path is a directory, use a recursive method to copy it")
+
+// ErrShortRead is returned when the reader of an upload yields fewer bytes than the announced size.
+var ErrShortRead = errors.New("reader yielded fewer bytes than the announced size")
+
+// ErrNotDirectory is returned when walking a remote path that is not a directory.
+var ErrNotDirectory = errors.New("remote path is not a directory")
+
+// ErrPreserveTimesUnsupported is returned when the remote scp rejects the modification and access
+// time of an uploaded file.
+var ErrPreserveTimesUnsupported = errors.New("remote scp does not support preserving file times")
+
+// ErrResponseTimeout is returned when the remote did not respond within `ResponseTimeout`.
+var ErrResponseTimeout = errors.New("remote did not respond in time")
+
+// ErrConnectionClosed is returned when the remote closed the session without responding and
+// without an exit status. This happens when the server rejects the session after opening it,
+// for example because `MaxSessions` of sshd was exceeded.
+var ErrConnectionClosed = errors.New("remote closed the session without a response, the server may have rejected it")
+
+// ErrFileTooLarge is returned when the remote announces a file that is larger than `MaxFileSize`.
+var ErrFileTooLarge = errors.New("remote file exceeds the maximum file size")
+
+// ErrRelativePath is returned for a remote path that is not absolute when `RequireAbsolutePaths` is set.
+var ErrRelativePath = errors.New("remote path is not absolute")
+
+// defaultCommandTimeout the time auxiliary commands may take when `CommandTimeout` is zero.
+const defaultCommandTimeout = 30 * time.Second
+
+// ErrNotConnected is returned when the client has no connection to the remote, because
+// `Connect` was not called or failed, or the client is the zero value.
+var ErrNotConnected = errors.New("client is not connected to the remote, call Connect first")
+
+// ErrRemoteIsDirectory is returned by uploads when the remote path is an existing directory
+// rather than a file, when `RejectDirTarget` is set.
+var ErrRemoteIsDirectory = errors.New("remote path is an existing directory, not a file")
+
+// ErrInvalidFilename is returned by uploads when the name the file is stored under is invalid,
+// or can not be determined from the remote path.
+var ErrInvalidFilename = errors.New("invalid file name")
+
+// RemoteError is returned when the remote scp command fails, it holds what the
+// command wrote to its standard error as that usually explains the failure.
+type RemoteError struct {
+	// Err the error reported by the SSH session, usually an *ssh.ExitError.
+	Err error
+
+	// Stderr the output the remote command wrote to its standard error.
+	Stderr string
+}
+
+func (e *RemoteError) Error() string {
+	stderr := strings.TrimSpace(e.Stderr)
+	if stderr == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.Err, stderr)
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
 // Callback for freeing managed resources
 type ICloseHandler interface {
-	Close()
+	Close() error
 }
 
 // Close handler equivalent to a no-op. Used by default
 // when no resources have to be cleaned.
 type EmptyHandler struct{}
 
-func (EmptyHandler) Close() {}
+func (EmptyHandler) Close() error { return nil }
 
 // Close handler to close an SSH client
 type CloseSSHCLient struct {
@@ -37,12 +105,20 @@ type CloseSSHCLient struct {
 	sshClient *ssh.Client
 }
 
-func (scp CloseSSHCLient) Close() {
-	scp.sshClient.Close()
+func (scp CloseSSHCLient) Close() error {
+	return scp.sshClient.Close()
 }
 
 type PassThru func(r io.Reader, total int64) io.Reader
 
+// PassThruDone can be implemented by the reader returned by a PassThru to be told when the
+// transfer has ended, for example to render a progress bar at 100% and tear it down.
+// Done is called exactly once, after the remote confirmed the file was transferred, with
+// a nil error on success and with the error of the transfer otherwise.
+type PassThruDone interface {
+	Done(err error)
+}
+
 type Client struct {
 	// Host the host to connect to.
 	Host string
@@ -53,71 +129,560 @@ type Client struct {
 	// Keep the ssh client around for generating new sessions
 	sshClient *ssh.Client
 
+	// Dialer when set, is used by `Connect` to open the connection to the remote, over
+	// which the SSH connection is then established. This allows connecting through a
+	// proxy, or over an in-memory connection in tests. Defaults to a net.Dialer.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// ConnectTimeout the maximal amount of time to wait for the connection to the
+	// remote to be established by `Connect`. It is used when `ClientConfig` does
+	// not set a timeout itself, zero means no timeout.
+	ConnectTimeout time.Duration
+
 	// Timeout the maximal amount of time to wait for a file transfer to complete.
+	// It is only used when the context passed for the transfer has no deadline.
 	// Deprecated: use context.Context for each function instead.
 	Timeout time.Duration
 
-	// RemoteBinary the absolute path to the remote SCP binary.
+	// ResponseTimeout the maximal amount of time a single read from the remote scp may block,
+	// such as waiting for it to acknowledge a record or to send the next part of a file. It
+	// detects a hung remote regardless of the size of the transfer, and applies even when the
+	// context has no deadline. The transfer fails with ErrResponseTimeout when it is exceeded.
+	// Writes to the remote are not covered. Zero means no limit.
+	ResponseTimeout time.Duration
+
+	// CommandTimeout the maximal amount of time to wait for the auxiliary commands run on the
+	// remote shell, such as `chmod` by `Chmod` or `chown` by `CopyFileWithOwner`, to finish.
+	// Transfers are not covered. Zero means the default of 30 seconds, a negative value means
+	// no limit. An error matching context.DeadlineExceeded and naming the command is returned
+	// when it is exceeded.
+	CommandTimeout time.Duration
+
+	// RemoteBinary the absolute path to the remote SCP binary. It may be prefixed with a
+	// wrapper it is run through, such as "sudo -n scp", as it is split on spaces. Use
+	// `RemoteCommand` for a path that contains spaces.
 	RemoteBinary string
 
+	// RemoteCommand the remote scp binary as a list of arguments, preceded by the wrapper it
+	// is run through if any, such as {"sudo", "-n", "/opt/my tools/scp"}. Every argument is
+	// quoted for the remote shell as needed. It takes precedence over `RemoteBinary`.
+	RemoteCommand []string
+
+	// UseSubsystem the name of an SSH subsystem the remote speaks the scp protocol over, for
+	// appliances that expose file transfers this way and do not allow executing commands. When
+	// set, transfers request the subsystem instead of running the remote scp binary, which is
+	// ignored. A subsystem takes no arguments, so the remote has to find out itself which
+	// files to send or receive. Methods running other commands on the remote shell, such as
+	// `Chmod` or `CopyTarToRemote`, still need the remote to allow executing commands.
+	UseSubsystem string
+
+	// Verbose runs the remote scp binary with `-v` rather than `-q`, so it writes diagnostics
+	// about the transfer to its standard error. They are included in the RemoteError returned
+	// when a transfer fails, up to the first 64 KiB. Defaults to quiet.
+	Verbose bool
+
+	// KeepAlive the interval at which keepalive requests are sent to the remote
+	// after connecting, preventing the remote from closing an idle connection.
+	// Keepalive requests are disabled when zero.
+	KeepAlive time.Duration
+
+	// AutoReconnect re-establishes the connection before a transfer if it was dropped
+	// since the previous one. It has no effect on SSH clients supplied by the user.
+	AutoReconnect bool
+
+	// RequireAbsolutePaths rejects remote paths that are not absolute with ErrRelativePath,
+	// rather than having the remote resolve them against the login directory.
+	RequireAbsolutePaths bool
+
+	// ExpandTilde resolves a leading "~" or "~user" in remote paths to the home directory of
+	// the login user or the named user, by asking the remote shell to expand it before the
+	// transfer. This costs an extra round trip to the remote for every such path.
+	ExpandTilde bool
+
+	// SFTPFallback transfers single files over SFTP instead when the remote has no scp binary,
+	// as some hardened hosts only provide SFTP. The fallback is only used when the remote shell
+	// reports the scp binary could not be found, and it is not available for directories,
+	// batches or globs. When scp is run through a wrapper such as sudo, the remote must name
+	// the scp binary in its error, so a missing wrapper fails the transfer instead of falling
+	// back to SFTP as the login user. The SFTP implementation is minimal, sending one request
+	// at a time.
+	SFTPFallback bool
+
+	// DryRun checks whether transfers would succeed without transferring anything.
+	//
+	// Uploads validate the permissions and run `test -d` and `test -w` on the remote
+	// directory the files would be written to, which requires a remote shell. Downloads
+	// check that the remote path exists and is of the expected kind with `StatRemote`.
+	// This predicts invalid permissions, missing remote files and directories, and remote
+	// directories that are not writable. It can not predict failures that only happen
+	// while writing, such as a full disk or an exceeded quota, an existing remote file that
+	// is read-only, remote files that are unreadable or change before the real transfer,
+	// or failures on the local side, as no local files are created or truncated.
+	DryRun bool
+
+	// BufferSize the size in bytes of the buffer the contents of files are copied through.
+	// When it is not set, the 32 KB buffer of io.Copy is used, which works well for most
+	// links. A larger buffer, such as 1 MB, can improve the throughput of links with a high
+	// bandwidth-delay product, at the cost of allocating it for every transfer.
+	BufferSize int
+
+	// PermissionMask when set, is ANDed with the permissions of every uploaded file and
+	// directory, enforcing a policy regardless of the permissions the caller asks for. For
+	// example 0755 makes sure uploads never end up writable by the group or by others.
+	// Zero means no mask, the permissions are used as they are.
+	PermissionMask os.FileMode
+
+	// RefuseSymlinks makes uploads fail with ErrRemoteSymlink when the remote path they
+	// write to is a symbolic link, which the remote scp would otherwise follow, for example
+	// into a file placed there by an attacker. The remote paths are checked with `test -L`
+	// before the transfer, which requires a remote shell and costs an extra round trip.
+	//
+	// This is a best effort check: a symbolic link created between the check and the
+	// transfer is still followed, as are symbolic links in the parent directories. For
+	// directory uploads only the remote directory itself is checked, not its contents.
+	RefuseSymlinks bool
+
+	// RejectDirTarget makes single file uploads, such as `CopyFile`, fail with
+	// ErrRemoteIsDirectory before sending anything when the file would be stored at the path
+	// of an existing remote directory, rather than create or replace a file. The path is
+	// checked with `StatRemote`, which costs an extra round trip. By default the upload is
+	// attempted, and the remote scp refuses to replace the directory with an error.
+	RejectDirTarget bool
+
+	// MaxFileSize the maximal size in bytes of a file to download. Downloads of larger files
+	// are aborted with ErrFileTooLarge as soon as the remote announces the size, before any
+	// of the contents are transferred, also when falling back to SFTP. Zero means no limit.
+	MaxFileSize int64
+
+	// Protocol parses the records sent by the remote scp when downloading, for servers that
+	// deviate from OpenSSH. Defaults to OpenSSHProtocol.
+	Protocol Protocol
+
+	// WarningHandler when set, is called with the message of every warning sent by the
+	// remote scp, which is a non-fatal error such as failing to set the times of a file.
+	WarningHandler func(message string)
+
+	// FailOnWarning fails a transfer with an error matching ErrRemoteWarning when the remote
+	// scp sends a warning after receiving the contents of a file, or instead of the next
+	// entry of a directory download. When unset, the transfer continues past these warnings,
+	// skipping the entry of the directory download. Other warnings always fail the transfer.
+	// Clients created by the constructors fail on warnings, as do all other transfers. Note
+	// that OpenSSH scp still exits with a failing status after sending a warning, failing
+	// the transfer with a RemoteError once all other files were transferred.
+	FailOnWarning bool
+
+	// MaxConcurrentSessions the maximal number of sessions open at the same time on the
+	// connection. Every transfer and remote command opens a session of its own, and those
+	// started while the maximum is reached wait for another one to finish. Clients created
+	// by the constructors default to 1, so transfers on a shared client run one at a time.
+	//
+	// To run transfers in parallel, raise it once the `MaxSessions` setting of the remote sshd
+	// is known, which defaults to 10 for OpenSSH and can be found with `sshd -T | grep -i
+	// maxsessions` on the remote. Zero means no limit, in which case the remote rejects the
+	// sessions above its own limit.
+	//
+	// Every transfer holds its session until it returns. Starting another transfer or remote
+	// command on the same client, or a copy of it, before that waits for that session, such
+	// as from a PassThru reader, a `WalkRemote` callback, a `FileSink`, `OnProgress` or
+	// `DirOptions.Progress`, or while a reader returned by `OpenRemote` or a `Transfer` is
+	// still open. With the default of 1, it waits until the context is done, as the session
+	// is never released. `CopyBetween` takes care of this itself.
+	MaxConcurrentSessions int
+
+	// Env the environment variables set on the remote before running the scp command, for
+	// remote scp wrappers that are configured through the environment. The remote sshd only
+	// accepts the variables listed in its `AcceptEnv` setting, transfers fail otherwise.
+	Env map[string]string
+
+	// OnProgress when set, is called while the contents of a single file are transferred, such
+	// as by `CopyFile` or `CopyFromRemote`, after every part of them is written, with the number
+	// of bytes written so far and the size of the file. It is called with both equal once the
+	// contents were written, also for empty files. It is called from the goroutine copying the
+	// contents, so concurrent transfers call it concurrently, and it should return quickly.
+	OnProgress func(bytesSoFar, total int64)
+
+	// ResumeState the path of a local file in which `CopyFromFile` records how far the upload
+	// of a file got, so a later call uploading the same file to the same remote path, such as
+	// after the connection dropped, resumes where it stopped rather than starting over. The
+	// file is read before and updated while uploading, and removed once the upload completed.
+	// Use a separate file for every upload running at the same time.
+	//
+	// As scp can only replace files, a new upload first replaces the remote file with an empty
+	// one, and an upload is resumed by appending the missing bytes with `AppendToRemote`,
+	// which requires a remote shell. The upload is only resumed when the local file has the
+	// same size and modification time as recorded, and the remote file is not larger than
+	// the number of bytes recorded as sent. The bytes already on the remote are not compared,
+	// so a local file modified without changing its size and modification time, or a remote
+	// file modified by others in the meantime, yields a corrupted copy.
+	ResumeState string
+
+	// Counts the open sessions for `MaxConcurrentSessions`, shared by copies of the client
+	sessions *sessionLimiter
+
 	// Handler called when calling `Close` to clean up any remaining
 	// resources managed by `Client`.
 	closeHandler ICloseHandler
+
+	// Sends the keepalive requests when `KeepAlive` is set
+	keepAlive *keepAlive
+
+	// Guards `sshClient`, `closeHandler` and `keepAlive`, which are replaced when reconnecting
+	// while other transfers may still use them
+	connMu *sync.RWMutex
+
+	// Delivers the events once `Events` has been called
+	events *eventsSlot
+
+	// The version returned by `RemoteSCPVersion`, once it is known, guarded by `connMu` and
+	// reset when connecting again
+	remoteSCPVersion string
 }
 
 // Connect connects to the remote SSH server, returns error if it couldn't establish a session to the SSH server.
 func (a *Client) Connect() error {
-	client, err := ssh.Dial("tcp", a.Host, a.ClientConfig)
+	return a.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to the remote SSH server like `Connect`, but gives up as soon as the
+// context is done, returning the context's error.
+func (a *Client) ConnectContext(ctx context.Context) error {
+	if a.connMu == nil {
+		a.connMu = &sync.RWMutex{}
+	}
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	return a.connect(ctx)
+}
+
+// connect dials the remote and replaces the connection, the caller must hold `connMu`.
+func (a *Client) connect(ctx context.Context) error {
+	config := a.ClientConfig
+	if config != nil && config.Timeout == 0 && a.ConnectTimeout > 0 {
+		configCopy := *config
+		configCopy.Timeout = a.ConnectTimeout
+		config = &configCopy
+	}
+
+	client, err := dial(ctx, a.Dialer, a.Host, config)
 	if err != nil {
 		return err
 	}
 
 	a.sshClient = client
 	a.closeHandler = CloseSSHCLient{sshClient: client}
+	// A new connection may reach another host behind the same address
+	a.remoteSCPVersion = ""
+	if a.sessions == nil {
+		a.sessions = &sessionLimiter{}
+	}
+
+	if a.keepAlive != nil {
+		a.keepAlive.stop()
+		a.keepAlive = nil
+	}
+	if a.KeepAlive > 0 {
+		a.keepAlive = startKeepAlive(client, a.KeepAlive)
+	}
+
+	a.emit(Connected{Host: a.Host})
 	return nil
 }
 
+// dial establishes an SSH connection to the given address like ssh.Dial, aborting both
+// the TCP connection and the SSH handshake when the context is done. The connection is
+// opened with `dialContext` if it is set, and with a net.Dialer otherwise.
+func dial(
+	ctx context.Context,
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error),
+	addr string,
+	config *ssh.ClientConfig,
+) (*ssh.Client, error) {
+	if config == nil {
+		return nil, errors.New("ssh client config is nil")
+	}
+
+	dialCtx := ctx
+	if dialContext == nil {
+		dialer := net.Dialer{Timeout: config.Timeout}
+		dialContext = dialer.DialContext
+	} else if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	conn, err := dialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// The handshake does not take a context, interrupt it by closing the connection.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	close(done)
+	<-stopped
+
+	if ctx.Err() != nil {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
 // Returns the underlying SSH client, this should be used carefully as
 // it will be closed by `client.Close`.
 func (a *Client) SSHClient() *ssh.Client {
-	return a.sshClient
+	sshClient, _ := a.connection()
+	return sshClient
+}
+
+// connection returns the current SSH connection and the keepalive requests checking it.
+func (a *Client) connection() (*ssh.Client, *keepAlive) {
+	if a.connMu == nil {
+		return a.sshClient, a.keepAlive
+	}
+	a.connMu.RLock()
+	defer a.connMu.RUnlock()
+	return a.sshClient, a.keepAlive
+}
+
+// probeConnection sends a keepalive request over the connection, giving up once the
+// context is done or `ResponseTimeout` is exceeded, as a connection that was silently
+// dropped only fails the request once the operating system gives up on it.
+func (a *Client) probeConnection(ctx context.Context, sshClient *ssh.Client) error {
+	if a.ResponseTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, a.ResponseTimeout, ErrResponseTimeout)
+		defer cancel()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrConnectionLost, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// IsConnected reports whether the client has a connection to the remote that is still alive.
+// This is checked with a keepalive request, which costs a round trip to the remote, use
+// `Ping` instead to bound the time the check may take with a context.
+func (a *Client) IsConnected() bool {
+	sshClient, keepAlive := a.connection()
+	if sshClient == nil {
+		return false
+	}
+
+	if keepAlive != nil && keepAlive.Err() != nil {
+		return false
+	}
+
+	_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
+}
+
+// Ping checks that the remote can be reached over the connection and that it accepts new
+// sessions, without transferring anything, which makes it suited for health checks.
+// No command is run on the remote, so it also works for accounts restricted to scp.
+func (a *Client) Ping(ctx context.Context) error {
+	if err := a.checkConnection(ctx); err != nil {
+		return err
+	}
+
+	sshClient, _ := a.connection()
+	if err := a.probeConnection(ctx, sshClient); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, closeSession, err := a.openSession(ctx)
+		if err != nil {
+			errCh <- fmt.Errorf("Error creating ssh session in ping: %w", err)
+			return
+		}
+		closeSession()
+		errCh <- nil
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkConnection ensures the connection can be used for a new transfer,
+// reconnecting if needed, or reports why it cannot.
+func (a *Client) checkConnection(ctx context.Context) error {
+	if sshClient, _ := a.connection(); sshClient == nil {
+		return ErrNotConnected
+	}
+
+	if err := a.reconnect(ctx); err != nil {
+		return fmt.Errorf("failed to reconnect: %w", err)
+	}
+
+	if _, keepAlive := a.connection(); keepAlive != nil {
+		return keepAlive.Err()
+	}
+
+	return nil
+}
+
+// reconnect checks whether the connection is still alive and dials the remote
+// again if it is not. Only connections established through `Connect` are
+// re-established, as user supplied SSH clients are managed by the user.
+func (a *Client) reconnect(ctx context.Context) error {
+	if !a.AutoReconnect || a.connMu == nil {
+		return nil
+	}
+
+	a.connMu.RLock()
+	sshClient, closeHandler, keepAlive := a.sshClient, a.closeHandler, a.keepAlive
+	a.connMu.RUnlock()
+
+	if _, ok := closeHandler.(CloseSSHCLient); !ok {
+		return nil
+	}
+
+	if keepAlive == nil || keepAlive.Err() == nil {
+		err := a.probeConnection(ctx, sshClient)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+	}
+
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+
+	// Another transfer may have reconnected or closed the client in the meantime
+	if a.sshClient != sshClient {
+		if a.sshClient == nil {
+			return ErrNotConnected
+		}
+		return nil
+	}
+
+	a.sshClient.Close()
+	return a.connect(ctx)
 }
 
 // CopyFromFile copies the contents of an os.File to a remote location, it will get the length of the file by looking it up from the filesystem.
 func (a *Client) CopyFromFile(
 	ctx context.Context,
-	file os.File,
+	file *os.File,
 	remotePath string,
 	permissions string,
+	opts ...CallOption,
 ) error {
-	return a.CopyFromFilePassThru(ctx, file, remotePath, permissions, nil)
+	return a.CopyFromFilePassThru(ctx, file, remotePath, permissions, nil, opts...)
 }
 
 // CopyFromFilePassThru copies the contents of an os.File to a remote location, it will get the length of the file by looking it up from the filesystem.
 // Access copied bytes by providing a PassThru reader factory.
 func (a *Client) CopyFromFilePassThru(
 	ctx context.Context,
-	file os.File,
+	file *os.File,
 	remotePath string,
 	permissions string,
 	passThru PassThru,
+	opts ...CallOption,
+) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	if a.ResumeState != "" && !a.DryRun {
+		return a.copyFromFileResumable(ctx, file, stat, remotePath, permissions, passThru, opts...)
+	}
+	return a.CopyPassThru(ctx, file, remotePath, permissions, stat.Size(), passThru, opts...)
+}
+
+// CopyFromFileWithSize copies `size` bytes of an os.File, read from its current offset, to a remote
+// location. Unlike `CopyFromFile` it does not stat the file, which is useful for files that can not
+// be stat'ed, such as some pipes, or to upload only the first part of a file. ErrShortRead is
+// returned if the file has fewer bytes than `size`.
+func (a *Client) CopyFromFileWithSize(
+	ctx context.Context,
+	file *os.File,
+	remotePath string,
+	permissions string,
+	size int64,
+	opts ...CallOption,
 ) error {
+	if size < 0 {
+		return fmt.Errorf("invalid size %d: must not be negative", size)
+	}
+	return a.CopyPassThru(ctx, file, remotePath, permissions, size, nil, opts...)
+}
+
+// UploadFile copies the local file at `localPath` to the remote location `remotePath`.
+// The remote file gets the given permissions, or those of the local file when `perm` is 0.
+func (a *Client) UploadFile(ctx context.Context, localPath, remotePath string, perm os.FileMode, opts ...CallOption) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer file.Close()
+
 	stat, err := file.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to stat file: %w", err)
 	}
-	return a.CopyPassThru(ctx, &file, remotePath, permissions, stat.Size(), passThru)
+
+	if perm == 0 {
+		perm = stat.Mode()
+	}
+
+	return a.CopyPassThru(ctx, file, remotePath, formatPermissions(perm), stat.Size(), nil, opts...)
 }
 
 // CopyFile copies the contents of an io.Reader to a remote location, the length is determined by reading the io.Reader until EOF
-// if the file length in know in advance please use "Copy" instead.
+// if the file length in know in advance please use "CopyN" instead.
+// Readers that implement io.Seeker, such as *os.File, are streamed directly
+// instead, their length is determined by seeking to their end. Any other reader
+// is read into memory first, which is a poor fit for large inputs.
 func (a *Client) CopyFile(
 	ctx context.Context,
 	fileReader io.Reader,
 	remotePath string,
 	permissions string,
+	opts ...CallOption,
 ) error {
-	return a.CopyFilePassThru(ctx, fileReader, remotePath, permissions, nil)
+	return a.CopyFilePassThru(ctx, fileReader, remotePath, permissions, nil, opts...)
 }
 
 // CopyFilePassThru copies the contents of an io.Reader to a remote location, the length is determined by reading the io.Reader until EOF
@@ -129,21 +694,38 @@ func (a *Client) CopyFilePassThru(
 	remotePath string,
 	permissions string,
 	passThru PassThru,
+	opts ...CallOption,
 ) error {
-	contentsBytes, err := ioutil.ReadAll(fileReader)
+	if _, err := ParsePermissions(permissions); err != nil {
+		return err
+	}
+
+	r, size, err := sizedReader(ctx, fileReader)
+	if err != nil {
+		return err
+	}
+
+	return a.CopyPassThru(ctx, r, remotePath, permissions, size, passThru, opts...)
+}
+
+// sizedReader returns a reader yielding the remaining contents of `r`, along with their size.
+// Seekable readers are streamed as they are, other readers are read into memory up front.
+func sizedReader(ctx context.Context, r io.Reader) (io.Reader, int64, error) {
+	if seeker, ok := r.(io.Seeker); ok {
+		if size, err := remainingSize(seeker); err == nil {
+			return r, size, nil
+		}
+	}
+
+	contentsBytes, err := readAll(ctx, r)
 	if err != nil {
-		return fmt.Errorf("failed to read all data from reader: %w", err)
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, fmt.Errorf("failed to read all data from reader: %w", err)
 	}
-	bytesReader := bytes.NewReader(contentsBytes)
 
-	return a.CopyPassThru(
-		ctx,
-		bytesReader,
-		remotePath,
-		permissions,
-		int64(len(contentsBytes)),
-		passThru,
-	)
+	return bytes.NewReader(contentsBytes), int64(len(contentsBytes)), nil
 }
 
 // wait waits for the waitgroup for the specified max timeout.
@@ -160,7 +742,7 @@ func wait(wg *sync.WaitGroup, ctx context.Context) error {
 		return nil
 
 	case <-ctx.Done():
-		return ctx.Err()
+		return context.Cause(ctx)
 	}
 }
 
@@ -176,6 +758,20 @@ func checkResponse(r io.Reader) error {
 
 }
 
+// CopyN copies exactly `size` bytes from the io.Reader to a remote location, streaming them
+// without buffering. This is the preferred way to upload large inputs whose size is known
+// in advance. ErrShortRead is returned if the reader runs out before `size` bytes were read.
+func (a *Client) CopyN(
+	ctx context.Context,
+	r io.Reader,
+	remotePath string,
+	permissions string,
+	size int64,
+	opts ...CallOption,
+) error {
+	return a.CopyPassThru(ctx, r, remotePath, permissions, size, nil, opts...)
+}
+
 // Copy copies the contents of an io.Reader to a remote location.
 func (a *Client) Copy(
 	ctx context.Context,
@@ -183,12 +779,38 @@ func (a *Client) Copy(
 	remotePath string,
 	permissions string,
 	size int64,
+	opts ...CallOption,
 ) error {
-	return a.CopyPassThru(ctx, r, remotePath, permissions, size, nil)
+	return a.CopyPassThru(ctx, r, remotePath, permissions, size, nil, opts...)
+}
+
+// CopyFileInfos copies the contents of an io.Reader to a remote location like `Copy`, and then
+// returns the metadata of the remote file as recorded by the remote, see `StatRemote`.
+func (a *Client) CopyFileInfos(
+	ctx context.Context,
+	r io.Reader,
+	remotePath string,
+	permissions string,
+	size int64,
+	opts ...CallOption,
+) (*FileInfos, error) {
+	if err := a.Copy(ctx, r, remotePath, permissions, size, opts...); err != nil {
+		return nil, err
+	}
+
+	_, _, remotePath, _ = uploadTarget(remotePath, a.callOptions(opts).filename)
+	return a.StatRemote(ctx, remotePath, opts...)
 }
 
 // CopyPassThru copies the contents of an io.Reader to a remote location.
-// Access copied bytes by providing a PassThru reader factory
+// Access copied bytes by providing a PassThru reader factory.
+//
+// A remote path ending in "/" is an existing directory the file is stored in, under the name
+// given with `WithFilename`, or under the base name of the directory without it. Any other
+// remote path is the path of the file itself, which is stored in its parent directory under
+// its base name. When a name is given with `WithFilename` for such a path, the path itself
+// is passed to the remote scp instead, which stores the file at that path, or under that
+// name when the path turns out to be an existing directory.
 func (a *Client) CopyPassThru(
 	ctx context.Context,
 	r io.Reader,
@@ -196,114 +818,565 @@ func (a *Client) CopyPassThru(
 	permissions string,
 	size int64,
 	passThru PassThru,
+	opts ...CallOption,
 ) error {
-	session, err := a.sshClient.NewSession()
+	mode, err := ParsePermissions(permissions)
 	if err != nil {
-		return fmt.Errorf("Error creating ssh session in copy to remote: %v", err)
+		return err
 	}
-	defer session.Close()
 
-	stdout, err := session.StdoutPipe()
+	remotePath, err = a.expandTilde(ctx, remotePath)
 	if err != nil {
 		return err
 	}
-	w, err := session.StdinPipe()
+
+	o := a.callOptions(opts)
+	target, filename, remotePath, err := uploadTarget(remotePath, o.filename)
 	if err != nil {
 		return err
 	}
-	defer w.Close()
+	dir := path.Dir(remotePath)
+
+	if err := a.checkNotSymlinks(ctx, dir, remotePath); err != nil {
+		return err
+	}
+
+	if a.RejectDirTarget {
+		// A missing remote file is fine, other failures are reported by the upload itself
+		if info, err := a.StatRemote(ctx, remotePath, opts...); err == nil && info.IsDir {
+			return fmt.Errorf("%w: %q", ErrRemoteIsDirectory, remotePath)
+		}
+	}
 
 	if passThru != nil {
 		r = passThru(r, size)
 	}
 
-	filename := path.Base(remotePath)
+	args := "-qt "
+	if !o.mtime.IsZero() {
+		args = "-qpt "
+	}
+
+	err = a.upload(ctx, args+quoteShell(target), dir, func(ctx context.Context, w io.WriteCloser, stdout io.Reader) error {
+		if !o.mtime.IsZero() {
+			if err := a.sendTimes(w, stdout, o.mtime, o.atime); err != nil {
+				return err
+			}
+		}
+		return a.sendFile(ctx, w, stdout, r, mode, size, remotePath, filename)
+	}, opts...)
+
+	if a.SFTPFallback && o.missingBinary(err) {
+		err = a.sftpUpload(ctx, r, remotePath, mode, size, o.mtime, o.atime)
+	}
+
+	if done, ok := r.(PassThruDone); ok && passThru != nil {
+		done.Done(err)
+	}
+	return err
+}
+
+// startSCP starts the remote scp binary with the given arguments on the session, which must
+// start with its flags, such as "-qt". The quiet flag is replaced by `-v` when `Verbose` is
+// set. The subsystem set with `UseSubsystem` is requested instead, which does not get the
+// arguments. It returns a function waiting for the remote to exit, to be used instead of
+// `session.Wait`.
+func (a *Client) startSCP(session *ssh.Session, args string, opts []CallOption) (func() error, error) {
+	if a.UseSubsystem != "" {
+		if err := session.RequestSubsystem(a.UseSubsystem); err != nil {
+			return nil, fmt.Errorf("failed to request the %q subsystem: %w", a.UseSubsystem, err)
+		}
+		// The session does not report how a subsystem exits, the responses of the
+		// scp protocol tell whether it succeeded.
+		return func() error { return nil }, nil
+	}
+
+	if a.Verbose {
+		args = "-v" + strings.TrimPrefix(strings.TrimPrefix(args, "-"), "q")
+	}
+
+	err := session.Start(fmt.Sprintf("%s %s", a.callOptions(opts).scpCommand(), args))
+	if err != nil {
+		return nil, err
+	}
+	return session.Wait, nil
+}
+
+// uploadTarget returns the remote path passed to the remote scp for a file uploaded to
+// `remotePath`, the name sent in its "C" record and the path the file is stored at, see
+// `CopyPassThru`. `filename` is the name given with `WithFilename`, if any.
+func uploadTarget(remotePath, filename string) (string, string, string, error) {
+	if filename != "" && !validFilename(filename) {
+		return "", "", "", fmt.Errorf("%w: %q", ErrInvalidFilename, filename)
+	}
+
+	if strings.HasSuffix(remotePath, "/") {
+		dir := path.Clean(remotePath)
+		if filename == "" {
+			filename = path.Base(dir)
+			if !validFilename(filename) {
+				return "", "", "", fmt.Errorf("%w: remote path %q has no name to store the file under, set it with WithFilename", ErrInvalidFilename, remotePath)
+			}
+		}
+		return dir, filename, path.Join(dir, filename), nil
+	}
+
+	if filename != "" {
+		// The remote scp only uses the name when the remote path is a directory
+		return remotePath, filename, remotePath, nil
+	}
+	return path.Dir(remotePath), path.Base(remotePath), path.Clean(remotePath), nil
+}
+
+// upload runs the remote scp binary with the given arguments to receive files, and calls
+// `send` to drive the scp protocol once the remote signalled it is ready. The context
+// passed to `send` is cancelled as soon as the transfer is aborted. `dir` is the remote
+// directory the files are written to, which is only checked for a dry run.
+func (a *Client) upload(
+	ctx context.Context,
+	args string,
+	dir string,
+	send func(ctx context.Context, w io.WriteCloser, stdout io.Reader) error,
+	opts ...CallOption,
+) error {
+	if err := a.checkRemotePath(dir); err != nil {
+		return err
+	}
+
+	if a.DryRun {
+		return a.checkWritable(ctx, dir)
+	}
+
+	if err := a.checkConnection(ctx); err != nil {
+		return err
+	}
+
+	session, closeSession, err := a.openSession(ctx)
+	if err != nil {
+		return fmt.Errorf("Error creating ssh session in copy to remote: %w", err)
+	}
+	defer closeSession()
+
+	if err := a.setEnv(session); err != nil {
+		return err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	stderr, err := captureStderr(session)
+	if err != nil {
+		return err
+	}
 
 	// Start the command first and get confirmation that it has been started
 	// before sending anything through the pipes.
-	err = session.Start(fmt.Sprintf("%s -qt %q", a.RemoteBinary, remotePath))
+	waitRemote, err := a.startSCP(session, args, opts)
 	if err != nil {
 		return err
 	}
 
+	// If there is a timeout, stop the transfer if it has been exceeded
+	ctx, cancelTimeout := a.transferContext(ctx)
+	defer cancelTimeout()
+
+	ctx, watch, stopWatch := a.watchResponses(ctx)
+	defer stopWatch()
+	stdout = watch(stdout)
+
+	// Stop streaming files as soon as the transfer is aborted
+	copyCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
-	errCh := make(chan error, 2)
+	var sendErr, waitErr error
 
 	// SCP protocol and file sending
 	go func() {
 		defer wg.Done()
 		defer w.Close()
 
-		_, err = fmt.Fprintln(w, "C"+permissions, size, filename)
-		if err != nil {
-			errCh <- err
-			return
-		}
-
-		if err = checkResponse(stdout); err != nil {
-			errCh <- err
-			return
-		}
-
-		_, err = io.Copy(w, r)
-		if err != nil {
-			errCh <- err
-			return
-		}
-
-		_, err = fmt.Fprint(w, "\x00")
-		if err != nil {
-			errCh <- err
+		// The remote signals that it is ready to receive files
+		if err := checkResponse(stdout); err != nil {
+			sendErr = err
 			return
 		}
 
-		if err = checkResponse(stdout); err != nil {
-			errCh <- err
-			return
-		}
+		sendErr = send(copyCtx, w, stdout)
 	}()
 
 	// Wait for the process to exit
 	go func() {
 		defer wg.Done()
-		err := session.Wait()
-		if err != nil {
-			errCh <- err
-			return
+		if err := waitRemote(); err != nil {
+			waitErr = err
+
+			// The remote gave up, stop reading the input. The sender closes stdin itself,
+			// as closing it while the sender writes to it is not safe.
+			cancel()
 		}
 	}()
 
-	// If there is a timeout, stop the transfer if it has been exceeded
-	if a.Timeout > 0 {
+	// Wait for one of the conditions (error/timeout/completion) to occur
+	if err := wait(&wg, ctx); err != nil {
+		return err
+	}
+
+	// Errors reported through the scp protocol explain the failure best, but when
+	// the remote hung up without a word its standard error is all there is.
+	// Sending may also have been stopped because the remote gave up.
+	stopped := waitErr != nil && errors.Is(sendErr, context.Canceled)
+	if sendErr != nil && !hungUp(sendErr) && !stopped {
+		return sendErr
+	}
+	if hungUp(sendErr) {
+		return hangUpError(sendErr, waitErr, stderr)
+	}
+	if waitErr != nil {
+		return &RemoteError{Err: waitErr, Stderr: stderr()}
+	}
+	return sendErr
+}
+
+// hungUp reports whether the error only tells that the remote stopped communicating, such as
+// reading from or writing to a closed pipe, rather than why it did so.
+func hungUp(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// hangUpError explains why the remote hung up, given the error that noticed it and the error
+// of waiting for the session. The output of the remote explains it best if it exited with a
+// status or wrote to its standard error, otherwise the session was closed without a word.
+func hangUpError(err, waitErr error, stderr func() string) error {
+	var exitErr *ssh.ExitError
+	if errors.As(waitErr, &exitErr) || (waitErr != nil && stderr() != "") {
+		return &RemoteError{Err: waitErr, Stderr: stderr()}
+	}
+	return fmt.Errorf("%w: %w", ErrConnectionClosed, err)
+}
+
+// transferContext applies `Timeout` to the context of a transfer, unless the context has a
+// deadline of its own, which then takes precedence.
+func (a *Client) transferContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || a.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, a.Timeout)
+}
+
+// watchResponses cancels the returned context with ErrResponseTimeout as soon as a read from
+// a reader wrapped by `watch` blocks for longer than `ResponseTimeout`, which also aborts the
+// transfer. `stop` must be called once the transfer is done.
+func (a *Client) watchResponses(ctx context.Context) (_ context.Context, watch func(io.Reader) io.Reader, stop func()) {
+	if a.ResponseTimeout <= 0 {
+		return ctx, func(r io.Reader) io.Reader { return r }, func() {}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	timeout := a.ResponseTimeout
+	watch = func(r io.Reader) io.Reader {
+		return &responseReader{r: r, timeout: timeout, expired: func() { cancel(ErrResponseTimeout) }}
+	}
+	return ctx, watch, func() { cancel(nil) }
+}
+
+// responseReader runs `expired` when a read from the wrapped reader blocks for longer than
+// `timeout`.
+type responseReader struct {
+	r       io.Reader
+	timeout time.Duration
+	expired func()
+}
+
+func (r *responseReader) Read(p []byte) (int, error) {
+	timer := time.AfterFunc(r.timeout, r.expired)
+	defer timer.Stop()
+	return r.r.Read(p)
+}
+
+// maskPermissions applies `PermissionMask` to the permissions of an upload.
+func (a *Client) maskPermissions(mode os.FileMode) os.FileMode {
+	if a.PermissionMask == 0 {
+		return mode
+	}
+	return mode & a.PermissionMask
+}
+
+// buffer allocates the buffer a transfer copies the contents of a file through, or returns
+// nil when `BufferSize` is not set.
+func (a *Client) buffer() []byte {
+	if a.BufferSize <= 0 {
+		return nil
+	}
+	return make([]byte, a.BufferSize)
+}
+
+// checkRemotePath checks that the remote path is absolute if `RequireAbsolutePaths` is set.
+func (a *Client) checkRemotePath(remotePath string) error {
+	if a.RequireAbsolutePaths && !path.IsAbs(remotePath) {
+		return fmt.Errorf("%w: %q", ErrRelativePath, remotePath)
+	}
+	return nil
+}
+
+// checkWritable checks that `dir` is an existing remote directory that can be written to.
+func (a *Client) checkWritable(ctx context.Context, dir string) error {
+	quoted := quoteShell(dir)
+	_, err := a.runRemote(ctx, fmt.Sprintf("test -d %s && test -w %s", quoted, quoted))
+	if err != nil {
+		return fmt.Errorf("remote directory %q does not exist or is not writable: %w", dir, err)
+	}
+	return nil
+}
+
+// warning passes on a warning sent by the remote to `WarningHandler`, and returns nil when
+// `FailOnWarning` is unset so the transfer continues. Other errors are returned as is.
+func (a *Client) warning(err error) error {
+	if !errors.Is(err, ErrRemoteWarning) {
+		return err
+	}
+
+	if a.WarningHandler != nil {
+		a.WarningHandler(strings.TrimSuffix(err.Error(), "\n"))
+	}
+	if a.FailOnWarning {
+		return err
+	}
+	return nil
+}
+
+// protocol returns `Protocol`, or OpenSSHProtocol when it is not set.
+func (a *Client) protocol() Protocol {
+	if a.Protocol == nil {
+		return OpenSSHProtocol{}
+	}
+	return a.Protocol
+}
+
+// parseResponse reads the next response of the remote with `Protocol`. For the default
+// protocol, errors parsing the records name `remotePath`.
+func (a *Client) parseResponse(reader io.Reader, writer io.Writer, remotePath string) (*FileInfos, error) {
+	if a.Protocol == nil {
+		return parseResponse(reader, writer, remotePath)
+	}
+	return a.Protocol.ParseResponse(reader, writer)
+}
+
+// setEnv sets the environment variables of `Env` in the session, in sorted order.
+func (a *Client) setEnv(session *ssh.Session) error {
+	names := make([]string, 0, len(a.Env))
+	for name := range a.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := session.Setenv(name, a.Env[name]); err != nil {
+			return fmt.Errorf("failed to set the environment variable %q on the remote, check that sshd accepts it with AcceptEnv: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// runRemote runs a command on the remote and returns what it wrote to its standard output.
+// A RemoteError holding its standard error is returned if the command fails.
+// The command is stopped once `CommandTimeout` is exceeded.
+func (a *Client) runRemote(ctx context.Context, command string) ([]byte, error) {
+	timeout := a.CommandTimeout
+	if timeout == 0 {
+		timeout = defaultCommandTimeout
+	}
+	if timeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, fmt.Errorf("remote command %q did not finish within %s: %w", command, timeout, context.DeadlineExceeded))
 		defer cancel()
 	}
 
-	// Wait for one of the conditions (error/timeout/completion) to occur
-	if err := wait(&wg, ctx); err != nil {
-		return err
+	return a.runRemoteInput(ctx, command, nil)
+}
+
+// runRemoteInput runs a command on the remote like `runRemote`, feeding it `stdin` as its
+// standard input when it is not nil.
+func (a *Client) runRemoteInput(ctx context.Context, command string, stdin io.Reader) ([]byte, error) {
+	if err := a.checkConnection(ctx); err != nil {
+		return nil, err
 	}
 
-	close(errCh)
+	session, closeSession, err := a.openSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating ssh session: %w", err)
+	}
+	defer closeSession()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stdout = &stdout
+	session.Stderr = &stderr
 
-	// Collect any errors from the error channel
-	for err := range errCh {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- session.Run(command)
+	}()
+
+	select {
+	case err := <-errCh:
 		if err != nil {
-			return err
+			return nil, &RemoteError{Err: err, Stderr: stderr.String()}
+		}
+		return stdout.Bytes(), nil
+
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// sendFile sends a single file to a remote scp that is ready to receive it, announcing
+// it with a "C" record, and waits for the remote to confirm it has been received.
+// `remotePath` is where the file ends up, which is only used to report on the transfer.
+// The writer is closed when the transfer has to be aborted.
+func (a *Client) sendFile(
+	ctx context.Context,
+	w io.WriteCloser,
+	stdout io.Reader,
+	r io.Reader,
+	mode os.FileMode,
+	size int64,
+	remotePath string,
+	filename string,
+) (err error) {
+	r, finish := a.trackTransfer(remotePath, size, r)
+	defer func() { finish(err) }()
+
+	err = a.writeCommand(w, Command{Type: Create, Mode: mode, Size: size, Name: filename})
+	if err != nil {
+		return err
+	}
+
+	if err := checkResponse(stdout); err != nil {
+		// The remote refused the file, do not send it anything else.
+		w.Close()
+		return err
+	}
+
+	n, err := a.copyContents(ctx, pipeWriter{w: w}, r, size)
+	if err != nil {
+		// Abort the transfer by closing stdin, as the remote would
+		// otherwise keep waiting for the remaining bytes.
+		w.Close()
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: expected %d bytes, sent %d", ErrShortRead, size, n)
 		}
+		return fmt.Errorf("expected %d bytes, sent %d: %w", size, n, err)
+	}
+
+	_, err = fmt.Fprint(w, "\x00")
+	if err != nil {
+		return err
 	}
 
+	// The file has been stored, unless the remote sends an error rather than a warning
+	return a.warning(checkResponse(stdout))
+}
+
+// sendTimes sends the modification and access time of the file that is sent next to a remote
+// scp with a "T" record. ErrPreserveTimesUnsupported is returned if the remote rejects them.
+func (a *Client) sendTimes(w io.WriteCloser, stdout io.Reader, mtime, atime time.Time) error {
+	err := a.writeCommand(w, Command{Type: Time, Mtime: mtime, Atime: atime})
+	if err != nil {
+		return err
+	}
+
+	if err := checkResponse(stdout); err != nil {
+		// The remote refused the times, do not send it anything else.
+		w.Close()
+		if hungUp(err) {
+			return err
+		}
+		return fmt.Errorf("%w: %s", ErrPreserveTimesUnsupported, strings.TrimSpace(err.Error()))
+	}
 	return nil
 }
 
+// sendDirectory announces a directory to a remote scp that is receiving recursively with a
+// "D" record, everything sent afterwards is placed in it until `endDirectory` is called.
+func (a *Client) sendDirectory(w io.Writer, stdout io.Reader, mode os.FileMode, dirname string) error {
+	err := a.writeCommand(w, Command{Type: Directory, Mode: mode, Name: dirname})
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(stdout)
+}
+
+// endDirectory tells a remote scp that is receiving recursively that the current directory
+// is complete with an "E" record.
+func (a *Client) endDirectory(w io.Writer, stdout io.Reader) error {
+	err := a.writeCommand(w, Command{Type: EndDirectory})
+	if err != nil {
+		return err
+	}
+
+	return checkResponse(stdout)
+}
+
+// writeCommand sends the record of the command to a remote scp receiving files. Every record
+// of an upload is sent through it, so `PermissionMask` is applied to the permissions of all
+// files and directories here.
+func (a *Client) writeCommand(w io.Writer, c Command) error {
+	if c.Type == Create || c.Type == Directory {
+		c.Mode = a.maskPermissions(c.Mode)
+	}
+
+	record, err := c.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", record)
+	return err
+}
+
 // CopyFromRemote copies a file from the remote to the local file given by the `file`
 // parameter. Use `CopyFromRemotePassThru` if a more generic writer
 // is desired instead of writing directly to a file on the file system.
-func (a *Client) CopyFromRemote(ctx context.Context, file *os.File, remotePath string) error {
-	return a.CopyFromRemotePassThru(ctx, file, remotePath, nil)
+func (a *Client) CopyFromRemote(ctx context.Context, file *os.File, remotePath string, opts ...CallOption) error {
+	return a.CopyFromRemotePassThru(ctx, file, remotePath, nil, opts...)
+}
+
+// DownloadFile copies a file from the remote to the local file at `localPath`. The local file is
+// created with the given permissions if it does not exist yet, and truncated otherwise.
+// If the transfer fails, the partially written local file is removed.
+func (a *Client) DownloadFile(ctx context.Context, remotePath, localPath string, perm os.FileMode, opts ...CallOption) error {
+	if a.DryRun {
+		// Leave the local file untouched
+		return a.CopyFromRemotePassThru(ctx, io.Discard, remotePath, nil, opts...)
+	}
+
+	file, err := os.OpenFile(localPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+
+	err = a.CopyFromRemotePassThru(ctx, file, remotePath, nil, opts...)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close local file: %w", closeErr)
+	}
+
+	if err != nil {
+		os.Remove(localPath)
+		return err
+	}
+
+	return nil
 }
 
 // CopyFromRemotePassThru copies a file from the remote to the given writer. The passThru parameter can be used
@@ -314,21 +1387,64 @@ func (a *Client) CopyFromRemotePassThru(
 	w io.Writer,
 	remotePath string,
 	passThru PassThru,
+	opts ...CallOption,
 ) error {
-	_, err := a.copyFromRemote(ctx, w, remotePath, passThru, false)
+	_, err := a.CopyFromRemoteCount(ctx, w, remotePath, passThru, opts...)
 
 	return err
 }
 
-// CopyFroRemoteFileInfos copies a file from the remote to a given writer and return a FileInfos struct
-// containing information about the file such as permissions, the file size, modification time and access time
+// CopyFromRemoteAt copies a file from the remote to the given io.WriterAt, writing its contents
+// starting at `offset`. This allows downloading into a specific part of a pre-allocated file.
+func (a *Client) CopyFromRemoteAt(ctx context.Context, w io.WriterAt, offset int64, remotePath string, opts ...CallOption) error {
+	return a.CopyFromRemotePassThru(ctx, io.NewOffsetWriter(w, offset), remotePath, nil, opts...)
+}
+
+// CopyFromRemoteCount copies a file from the remote to the given writer like `CopyFromRemotePassThru`,
+// and returns the number of bytes written to the writer. When the transfer fails, this is
+// the number of bytes that were written before it failed.
+func (a *Client) CopyFromRemoteCount(
+	ctx context.Context,
+	w io.Writer,
+	remotePath string,
+	passThru PassThru,
+	opts ...CallOption,
+) (int64, error) {
+	_, written, err := a.copyFromRemote(ctx, w, remotePath, passThru, false, opts...)
+
+	return written, err
+}
+
+// CopyFromRemoteFileInfos copies a file from the remote to a given writer and return a FileInfos struct
+// containing information about the file such as permissions, the file size, modification time and access time.
+//
+// If the transfer fails after the remote announced the file, such as while copying its contents,
+// the FileInfos are returned alongside the error. They may be partially populated, the times are
+// zero when the remote did not send them. The FileInfos are nil if the remote failed before
+// announcing the file.
 func (a *Client) CopyFromRemoteFileInfos(
 	ctx context.Context,
 	w io.Writer,
 	remotePath string,
 	passThru PassThru,
+	opts ...CallOption,
+) (*FileInfos, error) {
+	fileInfos, _, err := a.copyFromRemote(ctx, w, remotePath, passThru, true, opts...)
+
+	return fileInfos, err
+}
+
+// CopyFromRemoteHashed copies a file from the remote to the given writer like `CopyFromRemoteFileInfos`,
+// while also writing its contents to `h`, so its digest is computed in the same pass. Read
+// the digest with `h.Sum(nil)` once the transfer succeeded.
+func (a *Client) CopyFromRemoteHashed(
+	ctx context.Context,
+	w io.Writer,
+	remotePath string,
+	h hash.Hash,
+	opts ...CallOption,
 ) (*FileInfos, error) {
-	return a.copyFromRemote(ctx, w, remotePath, passThru, true)
+	return a.CopyFromRemoteFileInfos(ctx, io.MultiWriter(w, h), remotePath, nil, opts...)
 }
 
 func (a *Client) copyFromRemote(
@@ -337,16 +1453,72 @@ func (a *Client) copyFromRemote(
 	remotePath string,
 	passThru PassThru,
 	preserveFileTimes bool,
-) (*FileInfos, error) {
-	session, err := a.sshClient.NewSession()
+	opts ...CallOption,
+) (*FileInfos, int64, error) {
+	remotePath, err := a.expandTilde(ctx, remotePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := a.checkRemotePath(remotePath); err != nil {
+		return nil, 0, err
+	}
+
+	fileInfos, written, err := a.copyFromRemoteSCP(ctx, w, remotePath, passThru, preserveFileTimes, opts)
+	// The scp session is closed by now, the fallback needs a session of its own
+	if a.SFTPFallback && a.callOptions(opts).missingBinary(err) {
+		return a.sftpDownload(ctx, w, remotePath, passThru)
+	}
+	return fileInfos, written, err
+}
+
+// copyFromRemoteSCP downloads the file at `remotePath` with a remote scp, see `copyFromRemote`.
+func (a *Client) copyFromRemoteSCP(
+	ctx context.Context,
+	w io.Writer,
+	remotePath string,
+	passThru PassThru,
+	preserveFileTimes bool,
+	opts []CallOption,
+) (*FileInfos, int64, error) {
+	if a.DryRun {
+		fileInfos, err := a.StatRemote(ctx, remotePath, opts...)
+		if err != nil {
+			return nil, 0, err
+		}
+		if fileInfos.IsDir {
+			return nil, 0, ErrIsDirectory
+		}
+		return fileInfos, 0, nil
+	}
+
+	if err := a.checkConnection(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	session, closeSession, err := a.openSession(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("Error creating ssh session in copy from remote: %v", err)
+		return nil, 0, fmt.Errorf("Error creating ssh session in copy from remote: %w", err)
+	}
+	defer closeSession()
+
+	if err := a.setEnv(session); err != nil {
+		return nil, 0, err
 	}
-	defer session.Close()
+
+	ctx, cancelTimeout := a.transferContext(ctx)
+	defer cancelTimeout()
+
+	ctx, watch, stopWatch := a.watchResponses(ctx)
+	defer stopWatch()
 
 	wg := sync.WaitGroup{}
 	errCh := make(chan error, 4)
-	var fileInfos *FileInfos
+	// Receives the file infos once the remote announced the file, so they can be returned
+	// even when the transfer is aborted while the contents are being copied
+	fileInfosCh := make(chan *FileInfos, 1)
+	// Counts the bytes written while they are copied, as the transfer may be aborted meanwhile
+	counter := &countingWriter{w: w}
 
 	wg.Add(1)
 	go func() {
@@ -365,6 +1537,7 @@ func (a *Client) copyFromRemote(
 			errCh <- err
 			return
 		}
+		r = watch(r)
 
 		in, err := session.StdinPipe()
 		if err != nil {
@@ -373,29 +1546,57 @@ func (a *Client) copyFromRemote(
 		}
 		defer in.Close()
 
+		stderr, err := captureStderr(session)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		args := "-f "
 		if preserveFileTimes {
-			err = session.Start(fmt.Sprintf("%s -pf %q", a.RemoteBinary, remotePath))
-		} else {
-			err = session.Start(fmt.Sprintf("%s -f %q", a.RemoteBinary, remotePath))
+			args = "-pf "
 		}
+		waitRemote, err := a.startSCP(session, args+quoteShell(remotePath), opts)
 		if err != nil {
 			errCh <- err
 			return
 		}
 
+		var fileInfo *FileInfos
 		err = Ack(in)
+		if err == nil {
+			fileInfo, err = a.parseResponse(r, in, remotePath)
+		}
+		if hungUp(err) {
+			err = hangUpError(err, waitRemote(), stderr)
+		}
 		if err != nil {
 			errCh <- err
 			return
 		}
 
-		fileInfo, err := ParseResponse(r, in)
-		if err != nil {
+		fileInfosCh <- fileInfo
+
+		if fileInfo.IsDir {
+			err = ErrIsDirectory
+			errCh <- err
+			return
+		}
+
+		if err = checkFileSize(in, remotePath, fileInfo, a.MaxFileSize); err != nil {
 			errCh <- err
 			return
 		}
 
-		fileInfos = fileInfo
+		// Find out whether the contents can be stored before the remote starts sending them
+		if f, ok := w.(*os.File); ok {
+			if _, err = f.Write(nil); err != nil {
+				err = fmt.Errorf("local file is not writable: %w", err)
+				abort(in, err.Error())
+				errCh <- err
+				return
+			}
+		}
 
 		err = Ack(in)
 		if err != nil {
@@ -405,9 +1606,15 @@ func (a *Client) copyFromRemote(
 
 		if passThru != nil {
 			r = passThru(r, fileInfo.Size)
+			if done, ok := r.(PassThruDone); ok {
+				defer func() { done.Done(err) }()
+			}
 		}
 
-		_, err = CopyN(w, r, fileInfo.Size)
+		r, finish := a.trackTransfer(remotePath, fileInfo.Size, r)
+		defer func() { finish(err) }()
+
+		_, err = a.copyContents(ctx, counter, r, fileInfo.Size)
 		if err != nil {
 			errCh <- err
 			return
@@ -419,28 +1626,57 @@ func (a *Client) copyFromRemote(
 			return
 		}
 
-		err = session.Wait()
+		err = waitRemote()
 		if err != nil {
+			err = &RemoteError{Err: err, Stderr: stderr()}
 			errCh <- err
 			return
 		}
 	}()
 
-	if a.Timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
-		defer cancel()
-	}
+	waitErr := wait(&wg, ctx)
 
-	if err := wait(&wg, ctx); err != nil {
-		return nil, err
+	var fileInfos *FileInfos
+	select {
+	case fileInfos = <-fileInfosCh:
+	default:
+	}
+	if waitErr != nil {
+		return fileInfos, counter.n.Load(), waitErr
 	}
 
 	finalErr := <-errCh
 	close(errCh)
-	return fileInfos, finalErr
+
+	return fileInfos, counter.n.Load(), finalErr
 }
 
-func (a *Client) Close() {
-	a.closeHandler.Close()
+// Close frees the resources managed by the client, closing the SSH connection
+// if it was established by `Connect`. The error from closing the connection
+// is returned. Close is safe to call multiple times, subsequent calls are no-ops.
+// Afterwards the client fails with ErrNotConnected until it is connected again.
+func (a *Client) Close() error {
+	if a.connMu != nil {
+		a.connMu.Lock()
+		defer a.connMu.Unlock()
+	}
+
+	if a.keepAlive != nil {
+		a.keepAlive.stop()
+		a.keepAlive = nil
+	}
+
+	if events := a.queue(); events != nil {
+		events.close()
+	}
+
+	if a.closeHandler == nil {
+		a.sshClient = nil
+		return nil
+	}
+
+	err := a.closeHandler.Close()
+	a.closeHandler = EmptyHandler{}
+	a.sshClient = nil
+	return err
 }
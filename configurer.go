@@ -7,6 +7,9 @@
 package scp
 
 import (
+	"context"
+	"net"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -15,12 +18,15 @@ import (
 // ClientConfigurer a struct containing all the configuration options
 // used by an scp client.
 type ClientConfigurer struct {
-	host         string
-	clientConfig *ssh.ClientConfig
-	session      *ssh.Session
-	timeout      time.Duration
-	remoteBinary string
-	sshClient    *ssh.Client
+	host           string
+	clientConfig   *ssh.ClientConfig
+	session        *ssh.Session
+	timeout        time.Duration
+	connectTimeout time.Duration
+	remoteBinary   string
+	remoteCommand  []string
+	sshClient      *ssh.Client
+	dialer         func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 // NewConfigurer creates a new client configurer.
@@ -32,10 +38,11 @@ type ClientConfigurer struct {
 // ClientConfigurer struct.
 func NewConfigurer(host string, config *ssh.ClientConfig) *ClientConfigurer {
 	return &ClientConfigurer{
-		host:         host,
-		clientConfig: config,
-		timeout:      0, // no timeout by default
-		remoteBinary: "scp",
+		host:           host,
+		clientConfig:   config,
+		timeout:        0, // no timeout by default
+		connectTimeout: 30 * time.Second,
+		remoteBinary:   "scp",
 	}
 }
 
@@ -46,6 +53,13 @@ func (c *ClientConfigurer) RemoteBinary(path string) *ClientConfigurer {
 	return c
 }
 
+// RemoteCommand sets the remote scp binary as a list of arguments, which takes precedence
+// over `RemoteBinary`, see `Client.RemoteCommand`.
+func (c *ClientConfigurer) RemoteCommand(args ...string) *ClientConfigurer {
+	c.remoteCommand = args
+	return c
+}
+
 // Host alters the host of the client connects to.
 func (c *ClientConfigurer) Host(host string) *ClientConfigurer {
 	c.host = host
@@ -59,25 +73,50 @@ func (c *ClientConfigurer) Timeout(timeout time.Duration) *ClientConfigurer {
 	return c
 }
 
+// ConnectTimeout changes the maximal amount of time to wait for the connection
+// to the remote to be established, unless the ssh.ClientConfig sets its own timeout.
+// Defaults to 30 seconds.
+func (c *ClientConfigurer) ConnectTimeout(timeout time.Duration) *ClientConfigurer {
+	c.connectTimeout = timeout
+	return c
+}
+
 // ClientConfig alters the ssh.ClientConfig.
 func (c *ClientConfigurer) ClientConfig(config *ssh.ClientConfig) *ClientConfigurer {
 	c.clientConfig = config
 	return c
 }
 
+// Dialer sets the function used to open the connection to the remote, instead of a net.Dialer.
+func (c *ClientConfigurer) Dialer(dialer func(ctx context.Context, network, addr string) (net.Conn, error)) *ClientConfigurer {
+	c.dialer = dialer
+	return c
+}
+
 func (c *ClientConfigurer) SSHClient(sshClient *ssh.Client) *ClientConfigurer {
 	c.sshClient = sshClient
 	return c
 }
 
 // Create builds a client with the configuration stored within the ClientConfigurer.
+// The client is returned by value, take its address once and do not copy it after
+// connecting, see `New`.
 func (c *ClientConfigurer) Create() Client {
 	return Client{
-		Host:         c.host,
-		ClientConfig: c.clientConfig,
-		Timeout:      c.timeout,
-		RemoteBinary: c.remoteBinary,
-		sshClient:    c.sshClient,
-		closeHandler: EmptyHandler{},
+		Host:           c.host,
+		ClientConfig:   c.clientConfig,
+		Timeout:        c.timeout,
+		ConnectTimeout: c.connectTimeout,
+		RemoteBinary:   c.remoteBinary,
+		RemoteCommand:  c.remoteCommand,
+		sshClient:      c.sshClient,
+		Dialer:         c.dialer,
+		closeHandler:   EmptyHandler{},
+		sessions:       &sessionLimiter{},
+		connMu:         &sync.RWMutex{},
+		events:         &eventsSlot{},
+
+		FailOnWarning:         true,
+		MaxConcurrentSessions: defaultMaxConcurrentSessions,
 	}
 }
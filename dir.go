@@ -0,0 +1,423 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileSink is called for every file received during a directory download and returns
+// the writer its contents are written to, which is closed once the file is received.
+// Returning a nil writer and a nil error skips the file.
+type FileSink func(info FileInfos) (io.WriteCloser, error)
+
+// DirProgress is called while a directory tree is transferred to report on the file that is
+// currently being transferred. `current` describes the file, its `Path` is the remote path.
+// `fileIndex` is the zero based position of the file in the transfer and `totalFiles` the
+// number of files in the transfer, which is -1 when it is not known in advance, as is the
+// case for downloads. `bytesInFile` is the number of bytes of the file transferred so far.
+//
+// It is called with `bytesInFile` set to zero when a file starts, every time more of it has
+// been transferred, and a last time once all `current.Size` bytes have been transferred.
+// It is not called for directories.
+type DirProgress func(current FileInfos, fileIndex, totalFiles int, bytesInFile int64)
+
+// DirOptions the options for transferring a directory tree.
+type DirOptions struct {
+	// FileSink when set, receives the files downloaded by `CopyDirFromRemote` instead
+	// of them being written to the local directory.
+	FileSink FileSink
+
+	// Progress when set, is called to report on the progress of `CopyDirToRemote`
+	// and `CopyDirFromRemote`.
+	Progress DirProgress
+
+	// SymlinkMode how `CopyDirToRemote` handles symbolic links in the local directory,
+	// they are skipped by default.
+	SymlinkMode SymlinkMode
+}
+
+// SymlinkMode how symbolic links are handled when uploading a directory tree.
+type SymlinkMode int
+
+const (
+	// SymlinkSkip skips symbolic links.
+	SymlinkSkip SymlinkMode = iota
+
+	// SymlinkFollow uploads the file or directory a symbolic link points to in its place,
+	// like `scp -r` does. Symbolic links to other special files and broken symbolic links
+	// fail the transfer, as do symbolic links that loop.
+	SymlinkFollow
+
+	// SymlinkRecreate recreates symbolic links on the remote with `ln -s` once the files
+	// have been transferred, as scp itself can not send them. This requires a remote shell,
+	// and `ln` is run through the same wrapper as the remote scp binary.
+	//
+	// The targets are used as they are, so an absolute target or a relative target leaving
+	// the directory with ".." refers to whatever is at that path on the remote, which may
+	// be outside of the uploaded tree. Anyone who can write to the tree can then use such a
+	// link to have later writes through it land elsewhere, so only recreate symbolic links
+	// from trusted sources.
+	SymlinkRecreate
+)
+
+// progressReader reports the number of bytes read from the file it reads through DirProgress.
+type progressReader struct {
+	r         io.Reader
+	progress  DirProgress
+	current   FileInfos
+	fileIndex int
+	total     int
+	n         int64
+}
+
+func newProgressReader(r io.Reader, progress DirProgress, current FileInfos, fileIndex, total int) io.Reader {
+	if progress == nil {
+		return r
+	}
+
+	progress(current, fileIndex, total, 0)
+	return &progressReader{r: r, progress: progress, current: current, fileIndex: fileIndex, total: total}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.n += int64(n)
+		p.progress(p.current, p.fileIndex, p.total, p.n)
+	}
+	return n, err
+}
+
+// CopyDirFromRemote copies the contents of the remote directory `remoteDir` into the local
+// directory `localDir`, recreating the directory tree and creating `localDir` if needed.
+//
+// When `opts.FileSink` is set, the files are handed to it instead and no local files or
+// directories are created, `localDir` is not used in that case. `opts` may be nil.
+// ErrNotDirectory is returned if `remoteDir` is a plain file.
+func (a *Client) CopyDirFromRemote(ctx context.Context, remoteDir, localDir string, opts *DirOptions, callOpts ...CallOption) error {
+	if opts == nil {
+		opts = &DirOptions{}
+	}
+
+	remoteDir, err := a.expandTilde(ctx, remoteDir)
+	if err != nil {
+		return err
+	}
+
+	if a.DryRun {
+		info, err := a.StatRemote(ctx, remoteDir, callOpts...)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir {
+			return ErrNotDirectory
+		}
+		return nil
+	}
+
+	root := path.Clean(remoteDir)
+	localPath := func(info FileInfos) string {
+		return filepath.Join(localDir, filepath.FromSlash(strings.TrimPrefix(info.Path, root)))
+	}
+
+	sink := opts.FileSink
+	if sink == nil {
+		sink = func(info FileInfos) (io.WriteCloser, error) {
+			return os.OpenFile(
+				localPath(info),
+				os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+				os.FileMode(info.Permissions).Perm(),
+			)
+		}
+	}
+
+	fileIndex := 0
+	return a.receiveTree(ctx, remoteDir, true, func(info FileInfos, body io.Reader) error {
+		if info.IsDir {
+			if opts.FileSink != nil {
+				return nil
+			}
+
+			// Make sure we can write the contents of the directory
+			mode := os.FileMode(info.Permissions).Perm() | 0700
+			if err := os.MkdirAll(localPath(info), mode); err != nil {
+				return fmt.Errorf("failed to create local directory: %w", err)
+			}
+			return nil
+		}
+
+		w, err := sink(info)
+		if err != nil {
+			return err
+		}
+		if w == nil {
+			return nil
+		}
+
+		body = newProgressReader(body, opts.Progress, info, fileIndex, -1)
+		fileIndex++
+
+		body, finish := a.trackTransfer(info.Path, info.Size, body)
+		_, err = copyBuffer(w, body, a.BufferSize)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		finish(err)
+		return err
+	}, callOpts...)
+}
+
+// CopyDirToRemote copies the contents of the local directory `localDir` into the remote
+// directory `remoteDir`, recreating the directory tree using a single scp session.
+// `remoteDir` is created with the permissions of `localDir` if it does not exist yet,
+// its parent must exist. Special files are skipped, as are symbolic links unless
+// `opts.SymlinkMode` says otherwise.
+//
+// The files are listed before the transfer starts, so `opts.Progress` receives the
+// total number of files. `opts` may be nil.
+func (a *Client) CopyDirToRemote(ctx context.Context, localDir, remoteDir string, opts *DirOptions, callOpts ...CallOption) error {
+	if opts == nil {
+		opts = &DirOptions{}
+	}
+
+	remoteDir, err := a.expandTilde(ctx, remoteDir)
+	if err != nil {
+		return err
+	}
+
+	dirname := path.Base(remoteDir)
+	if dirname == "/" || dirname == "." || dirname == ".." {
+		return fmt.Errorf("invalid remote directory: %q", remoteDir)
+	}
+
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("local path %q is not a directory", localDir)
+	}
+
+	if err := a.checkNotSymlinks(ctx, remoteDir); err != nil {
+		return err
+	}
+
+	return a.sendTree(ctx, localDir, path.Clean(remoteDir), info.Mode(), opts, nil, callOpts...)
+}
+
+// sendTree sends the local directory tree `localDir` to the remote directory `remoteDir`
+// like `CopyDirToRemote`. When `include` is set, only the files for which it returns true
+// are sent, it is called with their remote path. All directories are sent regardless.
+func (a *Client) sendTree(
+	ctx context.Context,
+	localDir string,
+	remoteDir string,
+	dirMode os.FileMode,
+	opts *DirOptions,
+	include func(remotePath string) bool,
+	callOpts ...CallOption,
+) error {
+	included := func(localPath string) bool {
+		if include == nil {
+			return true
+		}
+		rel, err := filepath.Rel(localDir, localPath)
+		return err == nil && include(path.Join(remoteDir, filepath.ToSlash(rel)))
+	}
+
+	totalFiles := 0
+	var countFiles func(localPath string, ancestors []string) error
+	countFiles = func(localPath string, ancestors []string) error {
+		ancestors, err := enterLocalDir(localPath, ancestors, opts.SymlinkMode)
+		if err != nil {
+			return err
+		}
+
+		entries, err := os.ReadDir(localPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			entryLocalPath := filepath.Join(localPath, entry.Name())
+			info, _, err := resolveEntry(entryLocalPath, entry, opts.SymlinkMode)
+			if err != nil {
+				return err
+			}
+			if info == nil {
+				continue
+			}
+
+			if info.IsDir() {
+				if err := countFiles(entryLocalPath, ancestors); err != nil {
+					return err
+				}
+			} else if included(entryLocalPath) {
+				totalFiles++
+			}
+		}
+		return nil
+	}
+	if err := countFiles(localDir, nil); err != nil {
+		return err
+	}
+
+	// The symbolic links to recreate once the files have been sent
+	type symlink struct{ remotePath, target string }
+	var symlinks []symlink
+
+	fileIndex := 0
+	var sendDir func(ctx context.Context, w io.WriteCloser, stdout io.Reader, localPath, remotePath string, mode os.FileMode, ancestors []string) error
+	sendDir = func(ctx context.Context, w io.WriteCloser, stdout io.Reader, localPath, remotePath string, mode os.FileMode, ancestors []string) error {
+		ancestors, err := enterLocalDir(localPath, ancestors, opts.SymlinkMode)
+		if err != nil {
+			return err
+		}
+
+		if err := a.sendDirectory(w, stdout, mode.Perm(), path.Base(remotePath)); err != nil {
+			return fmt.Errorf("directory %q: %w", remotePath, err)
+		}
+
+		entries, err := os.ReadDir(localPath)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			entryLocalPath := filepath.Join(localPath, entry.Name())
+			entryRemotePath := path.Join(remotePath, entry.Name())
+
+			info, target, err := resolveEntry(entryLocalPath, entry, opts.SymlinkMode)
+			if err != nil {
+				return err
+			}
+			if target != "" && included(entryLocalPath) {
+				symlinks = append(symlinks, symlink{remotePath: entryRemotePath, target: target})
+			}
+			if info == nil {
+				continue
+			}
+
+			if info.IsDir() {
+				if err := sendDir(ctx, w, stdout, entryLocalPath, entryRemotePath, info.Mode(), ancestors); err != nil {
+					return err
+				}
+				continue
+			}
+			if !included(entryLocalPath) {
+				continue
+			}
+
+			if err := a.sendLocalFile(ctx, w, stdout, entryLocalPath, entryRemotePath, info, opts.Progress, fileIndex, totalFiles); err != nil {
+				return fmt.Errorf("file %q: %w", entryLocalPath, err)
+			}
+			fileIndex++
+		}
+
+		return a.endDirectory(w, stdout)
+	}
+
+	err := a.upload(ctx, "-qrt "+quoteShell(path.Dir(remoteDir)), path.Dir(remoteDir), func(ctx context.Context, w io.WriteCloser, stdout io.Reader) error {
+		return sendDir(ctx, w, stdout, localDir, remoteDir, dirMode, nil)
+	}, callOpts...)
+	if err != nil || len(symlinks) == 0 || a.DryRun {
+		return err
+	}
+
+	prefix := a.callOptions(callOpts).commandPrefix()
+	commands := make([]string, len(symlinks))
+	for i, link := range symlinks {
+		commands[i] = fmt.Sprintf("%sln -sfn -- %s %s", prefix, quoteShell(link.target), quoteShell(link.remotePath))
+	}
+	if _, err := a.runRemote(ctx, strings.Join(commands, " && ")); err != nil {
+		return fmt.Errorf("failed to recreate the symbolic links: %w", err)
+	}
+	return nil
+}
+
+// resolveEntry returns the file info of an entry of a local directory tree that is uploaded,
+// following symbolic links for SymlinkFollow. The info is nil for entries that are not sent,
+// along with the target of a symbolic link that is to be recreated for SymlinkRecreate.
+func resolveEntry(localPath string, entry fs.DirEntry, mode SymlinkMode) (fs.FileInfo, string, error) {
+	if entry.Type()&fs.ModeSymlink != 0 {
+		switch mode {
+		case SymlinkRecreate:
+			target, err := os.Readlink(localPath)
+			return nil, target, err
+
+		case SymlinkFollow:
+			info, err := os.Stat(localPath)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to follow symbolic link %q: %w", localPath, err)
+			}
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil, "", fmt.Errorf("symbolic link %q does not point to a file or directory", localPath)
+			}
+			return info, "", nil
+
+		default:
+			return nil, "", nil
+		}
+	}
+
+	if !entry.IsDir() && !entry.Type().IsRegular() {
+		return nil, "", nil
+	}
+	info, err := entry.Info()
+	return info, "", err
+}
+
+// enterLocalDir returns the directories leading to the local directory `localPath` for
+// SymlinkFollow, including itself, and fails if a symbolic link led back to one of them.
+func enterLocalDir(localPath string, ancestors []string, mode SymlinkMode) ([]string, error) {
+	if mode != SymlinkFollow {
+		return nil, nil
+	}
+
+	realPath, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, ancestor := range ancestors {
+		if ancestor == realPath {
+			return nil, fmt.Errorf("symbolic link loop at %q", localPath)
+		}
+	}
+	return append(ancestors[:len(ancestors):len(ancestors)], realPath), nil
+}
+
+// sendLocalFile sends the local file at `localPath` to a remote scp that is ready to receive it.
+func (a *Client) sendLocalFile(
+	ctx context.Context,
+	w io.WriteCloser,
+	stdout io.Reader,
+	localPath string,
+	remotePath string,
+	info fs.FileInfo,
+	progress DirProgress,
+	fileIndex int,
+	totalFiles int,
+) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	current := FileInfosFromStat(info)
+	current.Path = remotePath
+	r := newProgressReader(f, progress, *current, fileIndex, totalFiles)
+
+	return a.sendFile(ctx, w, stdout, r, info.Mode().Perm(), info.Size(), remotePath, info.Name())
+}
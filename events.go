@@ -0,0 +1,271 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransferEvent is an event emitted on the channel returned by `Client.Events`. It is one of
+// Connected, TransferStarted, Progress, TransferCompleted or TransferFailed.
+type TransferEvent interface {
+	transferEvent()
+}
+
+// Connected is emitted when the client established the connection to the remote.
+type Connected struct {
+	Host string
+}
+
+// TransferStarted is emitted when the contents of a file start to be transferred.
+type TransferStarted struct {
+	// Path the remote path of the file.
+	Path string
+
+	// Size the size of the file in bytes.
+	Size int64
+}
+
+// Progress is emitted every time part of the contents of a file has been transferred.
+type Progress struct {
+	// Path the remote path of the file.
+	Path string
+
+	// Bytes the number of bytes transferred so far.
+	Bytes int64
+}
+
+// TransferCompleted is emitted when a file has been transferred.
+type TransferCompleted struct {
+	// Path the remote path of the file.
+	Path string
+
+	// Bytes the number of bytes transferred.
+	Bytes int64
+
+	// Duration the time it took to transfer the file.
+	Duration time.Duration
+}
+
+// TransferFailed is emitted when the transfer of a file failed after it was started.
+type TransferFailed struct {
+	// Path the remote path of the file.
+	Path string
+
+	// Err the error the transfer failed with.
+	Err error
+}
+
+func (Connected) transferEvent()         {}
+func (TransferStarted) transferEvent()   {}
+func (Progress) transferEvent()          {}
+func (TransferCompleted) transferEvent() {}
+func (TransferFailed) transferEvent()    {}
+
+// eventsBufferSize the capacity of the events channel, it is also the number of events that
+// may be queued for a slow consumer before Progress events are dropped.
+const eventsBufferSize = 64
+
+// Events returns a channel on which the lifecycle events of the connection and of every file
+// transferred by the client are emitted, it is created by the first call. Call it before
+// connecting or starting transfers, as events are only emitted once it has been called.
+//
+// Events are emitted for the files transferred by all methods, except those that only
+// inspect the remote such as `StatRemote` and `WalkRemote`, and except dry runs.
+//
+// Emitting events never blocks a transfer. When the consumer falls behind, events are
+// queued, and Progress events are dropped while the queue is full, but the other events
+// are never dropped. The channel is closed by `Close` once the queued events have been
+// received, so keep receiving from it until it is closed.
+func (a *Client) Events() <-chan TransferEvent {
+	if a.events == nil {
+		a.events = &eventsSlot{}
+	}
+	if q := a.events.queue.Load(); q != nil {
+		return q.ch
+	}
+
+	q := newEventQueue()
+	if !a.events.queue.CompareAndSwap(nil, q) {
+		// Another call created the queue first
+		q.close()
+	}
+	return a.events.queue.Load().ch
+}
+
+// eventsSlot holds the queue of `Events` once it has been created, it is shared by copies
+// of the client so the queue is created only once.
+type eventsSlot struct {
+	queue atomic.Pointer[eventQueue]
+}
+
+// queue returns the queue of `Events`, or nil if it has not been called.
+func (a *Client) queue() *eventQueue {
+	if a.events == nil {
+		return nil
+	}
+	return a.events.queue.Load()
+}
+
+// emit queues the event for the consumer of `Events`, if there is any.
+func (a *Client) emit(event TransferEvent) {
+	if q := a.queue(); q != nil {
+		q.push(event)
+	}
+}
+
+// trackTransfer emits TransferStarted for the file at `remotePath`, and returns a reader
+// emitting Progress for every part of its contents that is read from `r`. The returned
+// function must be called with the result of the transfer once it ended, to emit
+// TransferCompleted or TransferFailed.
+func (a *Client) trackTransfer(remotePath string, size int64, r io.Reader) (io.Reader, func(err error)) {
+	events := a.queue()
+	if events == nil {
+		return r, func(error) {}
+	}
+
+	start := time.Now()
+	events.push(TransferStarted{Path: remotePath, Size: size})
+
+	tracked := &progressEventReader{r: r, events: events, path: remotePath}
+	return tracked, func(err error) {
+		if err != nil {
+			events.push(TransferFailed{Path: remotePath, Err: err})
+			return
+		}
+		events.push(TransferCompleted{Path: remotePath, Bytes: tracked.n, Duration: time.Since(start)})
+	}
+}
+
+// progressEventReader emits a Progress event for every read from the wrapped reader.
+type progressEventReader struct {
+	r      io.Reader
+	events *eventQueue
+	path   string
+	n      int64
+}
+
+func (r *progressEventReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		r.events.push(Progress{Path: r.path, Bytes: r.n})
+	}
+	return n, err
+}
+
+// copyContents copies the `size` bytes of the contents of a file from `r` to `w` like
+// copyNContext, calling `OnProgress` after every write.
+func (a *Client) copyContents(ctx context.Context, w io.Writer, r io.Reader, size int64) (int64, error) {
+	if a.OnProgress == nil {
+		return copyNContext(ctx, w, r, size, a.buffer())
+	}
+
+	n, err := copyNContext(ctx, &progressWriter{w: w, onProgress: a.OnProgress, total: size}, r, size, a.buffer())
+	if err == nil && size == 0 {
+		// Nothing was written, report the completion all the same
+		a.OnProgress(0, 0)
+	}
+	return n, err
+}
+
+// progressWriter calls `onProgress` after every write to the wrapped writer.
+type progressWriter struct {
+	w          io.Writer
+	onProgress func(bytesSoFar, total int64)
+	n          int64
+	total      int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if n > 0 {
+		p.n += int64(n)
+		p.onProgress(p.n, p.total)
+	}
+	return n, err
+}
+
+// eventQueue delivers the events to the channel returned by `Events` from a goroutine of
+// its own, so the transfers emitting them never wait for the consumer.
+type eventQueue struct {
+	ch chan TransferEvent
+
+	mu      sync.Mutex
+	pending []TransferEvent
+	closed  bool
+
+	// wake is signalled when events are pushed or the queue is closed
+	wake chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	q := &eventQueue{
+		ch:   make(chan TransferEvent, eventsBufferSize),
+		wake: make(chan struct{}, 1),
+	}
+	go q.run()
+	return q
+}
+
+// push queues the event, unless the queue is closed, or it is a Progress event and the
+// queue is full.
+func (q *eventQueue) push(event TransferEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	if _, ok := event.(Progress); ok && len(q.pending) >= eventsBufferSize {
+		return
+	}
+	q.pending = append(q.pending, event)
+	q.signal()
+}
+
+// close stops accepting events, the channel is closed once the queued events are delivered.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.signal()
+}
+
+func (q *eventQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *eventQueue) run() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.mu.Unlock()
+			<-q.wake
+			q.mu.Lock()
+		}
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			close(q.ch)
+			return
+		}
+		event := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		q.ch <- event
+	}
+}
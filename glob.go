@@ -0,0 +1,71 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// CopyGlobFromRemote copies all remote files matching the glob pattern `remoteGlob`, for
+// example "/var/log/*.log", into the local directory `localDir`, and returns the paths of
+// the local files it created. The pattern is expanded by the remote shell, only the
+// wildcards "*", "?" and "[...]" are special, the rest of the pattern is used verbatim.
+//
+// All matches are stored directly in `localDir` under their own name, so an error is
+// returned if two matches have the same name. Directories matching the pattern make the
+// remote report an error. On error, the paths of the files created so far are returned
+// alongside it.
+//
+// For a dry run, the matching files are still sent by the remote to find out which they
+// are, but they are discarded, and the paths the files would have been created at are
+// returned.
+func (a *Client) CopyGlobFromRemote(ctx context.Context, remoteGlob, localDir string, opts ...CallOption) ([]string, error) {
+	remoteGlob, err := a.expandTilde(ctx, remoteGlob)
+	if err != nil {
+		return nil, err
+	}
+
+	var created []string
+	seen := make(map[string]bool)
+
+	err = a.receive(ctx, "-f "+quoteGlob(remoteGlob), path.Dir(remoteGlob), false, func(info FileInfos, body io.Reader) error {
+		if info.IsDir {
+			return fmt.Errorf("%w: %q", ErrIsDirectory, info.Filename)
+		}
+		if seen[info.Filename] {
+			return fmt.Errorf("more than one remote file named %q matches %q", info.Filename, remoteGlob)
+		}
+		seen[info.Filename] = true
+
+		localPath := filepath.Join(localDir, info.Filename)
+		if a.DryRun {
+			created = append(created, localPath)
+			return nil
+		}
+
+		f, err := os.OpenFile(localPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(info.Permissions).Perm())
+		if err != nil {
+			return err
+		}
+		created = append(created, localPath)
+
+		body, finish := a.trackTransfer(path.Join(path.Dir(remoteGlob), info.Filename), info.Size, body)
+		_, err = copyBuffer(f, body, a.BufferSize)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		finish(err)
+		return err
+	}, opts...)
+
+	return created, err
+}
@@ -0,0 +1,74 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrConnectionLost is returned by a transfer when the keepalive requests
+// detected that the connection to the remote was lost.
+var ErrConnectionLost = errors.New("connection to the remote was lost")
+
+// keepAlive periodically sends keepalive requests over an SSH connection
+// so that the remote does not disconnect it while it is idle.
+type keepAlive struct {
+	done chan struct{}
+	once sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// startKeepAlive starts sending keepalive requests on the given connection
+// at the given interval until `stop` is called or a request fails.
+func startKeepAlive(client *ssh.Client, interval time.Duration) *keepAlive {
+	k := &keepAlive{done: make(chan struct{})}
+	go k.run(client, interval)
+	return k
+}
+
+func (k *keepAlive) run(client *ssh.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.done:
+			return
+
+		case <-ticker.C:
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			if err != nil {
+				k.mu.Lock()
+				k.err = fmt.Errorf("%w: %v", ErrConnectionLost, err)
+				k.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error that stopped the keepalive requests, or nil if
+// the connection is still believed to be alive.
+func (k *keepAlive) Err() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
+
+// stop stops sending keepalive requests, it is safe to call it multiple times.
+func (k *keepAlive) stop() {
+	k.once.Do(func() {
+		close(k.done)
+	})
+}
@@ -0,0 +1,50 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Move renames the remote file or directory `oldPath` to `newPath` by running `mv -f` on the
+// remote, replacing `newPath` if it exists. A RemoteError holding the output of `mv` is
+// returned if it fails.
+//
+// When the remote scp binary is run through a wrapper such as "sudo scp", `mv` is run through
+// the same wrapper, so it has the same privileges as the transfers.
+func (a *Client) Move(ctx context.Context, oldPath, newPath string, opts ...CallOption) error {
+	if oldPath == "" || newPath == "" {
+		return errors.New("remote paths to move must not be empty")
+	}
+
+	oldPath, err := a.expandTilde(ctx, oldPath)
+	if err != nil {
+		return err
+	}
+	newPath, err = a.expandTilde(ctx, newPath)
+	if err != nil {
+		return err
+	}
+
+	if err := a.checkRemotePath(oldPath); err != nil {
+		return err
+	}
+	if err := a.checkRemotePath(newPath); err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf(
+		"%smv -f -- %s %s",
+		a.callOptions(opts).commandPrefix(),
+		quoteShell(oldPath),
+		quoteShell(newPath),
+	)
+	_, err = a.runRemote(ctx, command)
+	return err
+}
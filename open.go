@@ -0,0 +1,221 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errClosedEarly is reported to `trackTransfer` when a remote file opened with `OpenRemote`
+// is closed before all of its contents were read.
+var errClosedEarly = errors.New("remote file closed before it was fully read")
+
+// OpenRemote opens the remote file at `remotePath` for reading, returning its metadata and a
+// reader yielding exactly `Size` bytes of its contents, so the download can be handed to
+// other readers such as a gzip reader or an HTTP response. io.ErrUnexpectedEOF is returned
+// by the reader if the remote stops sending before that.
+//
+// The reader must be closed, which ends the scp session. When all contents were read, Close
+// waits for the remote to confirm it sent the whole file and returns its error otherwise.
+// Closing the reader before that aborts the transfer and returns nil. The transfer is also
+// aborted as soon as the context is done.
+//
+// The fallback to SFTP is not available. For a dry run, the remote file is checked with
+// `StatRemote` and the reader yields nothing.
+func (a *Client) OpenRemote(ctx context.Context, remotePath string, opts ...CallOption) (io.ReadCloser, *FileInfos, error) {
+	remotePath, err := a.expandTilde(ctx, remotePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := a.checkRemotePath(remotePath); err != nil {
+		return nil, nil, err
+	}
+
+	if a.DryRun {
+		fileInfos, err := a.StatRemote(ctx, remotePath, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fileInfos.IsDir {
+			return nil, nil, ErrIsDirectory
+		}
+		return io.NopCloser(strings.NewReader("")), fileInfos, nil
+	}
+
+	if err := a.checkConnection(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	session, closeSession, err := a.openSession(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating ssh session in open remote: %w", err)
+	}
+
+	if err := a.setEnv(session); err != nil {
+		closeSession()
+		return nil, nil, err
+	}
+
+	f, err := a.openRemote(ctx, session, closeSession, remotePath, opts)
+	if err != nil {
+		closeSession()
+		return nil, nil, err
+	}
+	return f, f.info, nil
+}
+
+// openRemote starts `scp -pf` in the session and waits for the remote to announce the file.
+func (a *Client) openRemote(
+	ctx context.Context,
+	session *ssh.Session,
+	closeSession func(),
+	remotePath string,
+	opts []CallOption,
+) (*remoteFile, error) {
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	in, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := captureStderr(session)
+	if err != nil {
+		return nil, err
+	}
+
+	waitRemote, err := a.startSCP(session, "-pf "+quoteShell(remotePath), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Abort the transfer as soon as the context is done, including the handshake
+	ctx, cancelTimeout := a.transferContext(ctx)
+	ctx, watch, stopWatch := a.watchResponses(ctx)
+	stdout = watch(stdout)
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	cleanup := func() {
+		stop()
+		stopWatch()
+		cancelTimeout()
+	}
+
+	var info *FileInfos
+	err = Ack(in)
+	if err == nil {
+		info, err = a.parseResponse(stdout, in, remotePath)
+	}
+	if hungUp(err) && ctx.Err() == nil {
+		err = hangUpError(err, waitRemote(), stderr)
+	}
+	if err == nil && info.IsDir {
+		err = ErrIsDirectory
+	}
+	if err == nil {
+		err = checkFileSize(in, remotePath, info, a.MaxFileSize)
+	}
+	if err == nil {
+		// Let the remote start sending the contents
+		err = Ack(in)
+	}
+	if err != nil {
+		cleanup()
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		return nil, err
+	}
+
+	body, finish := a.trackTransfer(remotePath, info.Size, io.LimitReader(stdout, info.Size))
+	return &remoteFile{
+		ctx:          ctx,
+		waitRemote:   waitRemote,
+		closeSession: closeSession,
+		stdout:       stdout,
+		in:           in,
+		stderr:       stderr,
+		info:         info,
+		body:         body,
+		finish:       finish,
+		cleanup:      cleanup,
+	}, nil
+}
+
+// remoteFile reads the contents of a file sent by a remote `scp -f`.
+type remoteFile struct {
+	ctx          context.Context
+	waitRemote   func() error
+	closeSession func()
+	stdout       io.Reader
+	in           io.WriteCloser
+	stderr       func() string
+	info         *FileInfos
+	body         io.Reader
+	n            int64
+	finish       func(err error)
+	cleanup      func()
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	if f.ctx.Err() != nil {
+		return 0, context.Cause(f.ctx)
+	}
+
+	n, err := f.body.Read(p)
+	f.n += int64(n)
+	if err == io.EOF && f.n < f.info.Size {
+		if f.ctx.Err() != nil {
+			return n, context.Cause(f.ctx)
+		}
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Close ends the transfer, see `OpenRemote`.
+func (f *remoteFile) Close() error {
+	f.closeOnce.Do(func() {
+		defer f.cleanup()
+		defer f.closeSession()
+
+		if f.n < f.info.Size {
+			f.finish(errClosedEarly)
+			return
+		}
+
+		// The remote reports whether it could read the whole file
+		err := checkResponse(f.stdout)
+		if err == nil {
+			err = Ack(f.in)
+		}
+		f.in.Close()
+		if err == nil || hungUp(err) {
+			if waitErr := f.waitRemote(); waitErr != nil {
+				err = &RemoteError{Err: waitErr, Stderr: f.stderr()}
+			}
+		}
+		if err != nil && f.ctx.Err() != nil {
+			err = context.Cause(f.ctx)
+		}
+
+		f.finish(err)
+		f.closeErr = err
+	})
+	return f.closeErr
+}
@@ -0,0 +1,95 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"strings"
+	"time"
+)
+
+// CallOption alters the behaviour of a single call on a Client, without
+// changing the settings of the Client itself. This makes it safe to use
+// different options for concurrent calls on the same Client.
+type CallOption func(*callOptions)
+
+// callOptions the settings used by a single call.
+type callOptions struct {
+	remoteCommand []string
+	mtime         time.Time
+	atime         time.Time
+	filename      string
+}
+
+// WithRemoteBinary overrides the remote scp binary for a single call,
+// for example "sudo scp" to run a single transfer with elevated privileges.
+// It is split on spaces like `Client.RemoteBinary`.
+func WithRemoteBinary(remoteBinary string) CallOption {
+	return func(o *callOptions) {
+		o.remoteCommand = strings.Fields(remoteBinary)
+	}
+}
+
+// WithRemoteCommand overrides the remote scp binary for a single call, given as a
+// list of arguments like `Client.RemoteCommand`.
+func WithRemoteCommand(args ...string) CallOption {
+	return func(o *callOptions) {
+		o.remoteCommand = args
+	}
+}
+
+// WithFileTimes sets the modification and access time of a file uploaded by a single
+// file upload, such as `CopyFile`, which are otherwise set to the time of the upload.
+// A zero access time is set to the modification time. Pass the times of a local file to
+// preserve them. ErrPreserveTimesUnsupported is returned if the remote scp does not
+// accept them.
+func WithFileTimes(mtime, atime time.Time) CallOption {
+	return func(o *callOptions) {
+		o.mtime = mtime
+		o.atime = atime
+	}
+}
+
+// WithFilename overrides the file name sent to the remote scp by a single file upload, such
+// as `CopyFile`, which defaults to the base name of the remote path. The remote path is
+// still passed to the remote scp, which only uses the name when the remote path is an
+// existing directory, such as a remote path ending in "/", storing the file in it under that
+// name. Some servers use the name in other ways. See `CopyPassThru`.
+func WithFilename(filename string) CallOption {
+	return func(o *callOptions) {
+		o.filename = filename
+	}
+}
+
+// callOptions returns the settings for a single call, which are the
+// settings of the client altered by the given options.
+func (a *Client) callOptions(opts []CallOption) callOptions {
+	o := callOptions{
+		remoteCommand: a.RemoteCommand,
+	}
+	if len(o.remoteCommand) == 0 {
+		o.remoteCommand = strings.Fields(a.RemoteBinary)
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// scpCommand returns the remote scp binary, along with the wrapper it is run through,
+// as a command for the remote shell.
+func (o callOptions) scpCommand() string {
+	return quoteArgs(o.remoteCommand)
+}
+
+// commandPrefix returns the wrapper the remote scp binary is run through, such as "sudo "
+// for "sudo scp", so other remote commands can be run the same way.
+func (o callOptions) commandPrefix() string {
+	if len(o.remoteCommand) <= 1 {
+		return ""
+	}
+	return quoteArgs(o.remoteCommand[:len(o.remoteCommand)-1]) + " "
+}
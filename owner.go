@@ -0,0 +1,63 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CopyFileWithOwner copies the contents of an io.Reader to a remote location like `CopyFile`
+// and then hands the file to `owner` and `group` by running `chown` on the remote. Either of
+// them may be empty to leave it unchanged, the chown is skipped when both are empty.
+//
+// When the remote scp binary is run through a wrapper such as "sudo scp", `chown` is run
+// through the same wrapper, which is usually needed to give files away to another user.
+// If the chown fails the uploaded file is removed again, and the error of the chown is
+// returned, joined with the error of the removal if that failed as well.
+func (a *Client) CopyFileWithOwner(
+	ctx context.Context,
+	fileReader io.Reader,
+	remotePath string,
+	permissions string,
+	owner, group string,
+	opts ...CallOption,
+) error {
+	remotePath, err := a.expandTilde(ctx, remotePath)
+	if err != nil {
+		return err
+	}
+
+	if err := a.CopyFile(ctx, fileReader, remotePath, permissions, opts...); err != nil {
+		return err
+	}
+
+	// The upload already checked the remote path, so this can not fail
+	_, _, remotePath, _ = uploadTarget(remotePath, a.callOptions(opts).filename)
+	if (owner == "" && group == "") || a.DryRun {
+		return nil
+	}
+
+	ownership := owner
+	if group != "" {
+		ownership += ":" + group
+	}
+
+	prefix := a.callOptions(opts).commandPrefix()
+	_, err = a.runRemote(ctx, fmt.Sprintf("%schown -- %s %s", prefix, quoteShell(ownership), quoteShell(remotePath)))
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("failed to change the owner of %q to %q: %w", remotePath, ownership, err)
+	if _, rmErr := a.runRemote(ctx, fmt.Sprintf("%srm -f -- %s", prefix, quoteShell(remotePath))); rmErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to remove %q: %w", remotePath, rmErr))
+	}
+	return err
+}
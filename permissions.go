@@ -0,0 +1,62 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// ParsePermissions parses the octal permissions accepted by the upload methods, such as
+// "0644" or "644", into an os.FileMode. The setuid, setgid and sticky bits are mapped
+// onto their os.FileMode counterparts.
+func ParsePermissions(permissions string) (os.FileMode, error) {
+	if len(permissions) < 3 || len(permissions) > 4 {
+		return 0, fmt.Errorf("invalid permissions %q: expected 3 or 4 octal digits", permissions)
+	}
+
+	bits, err := strconv.ParseUint(permissions, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid permissions %q: expected 3 or 4 octal digits", permissions)
+	}
+
+	mode := os.FileMode(bits).Perm()
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode, nil
+}
+
+// formatPermissions formats the permissions of the mode as the four octal digits used by
+// the scp protocol, such as "0644".
+func formatPermissions(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", permissionBits(mode))
+}
+
+// permissionBits returns the permissions of the mode as the bits used by the scp protocol,
+// which is how they are stored in `FileInfos.Permissions`.
+func permissionBits(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
@@ -11,26 +11,136 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"strconv"
+	"os"
 	"strings"
 )
 
 type ResponseType = byte
 
 const (
-	Ok      ResponseType = 0
-	Warning ResponseType = 1
-	Error   ResponseType = 2
-	Create  ResponseType = 'C'
-	Time    ResponseType = 'T'
+	Ok           ResponseType = 0
+	Warning      ResponseType = 1
+	Error        ResponseType = 2
+	Create       ResponseType = 'C'
+	Time         ResponseType = 'T'
+	Directory    ResponseType = 'D'
+	EndDirectory ResponseType = 'E'
 )
 
+// ErrEndDirectory is returned by ParseResponse when the remote ends the directory it was
+// sending with an "E" record. It is not a failure, the entries that follow belong to the
+// parent directory.
+var ErrEndDirectory = errors.New("end of directory")
+
+// fileRecordFormat and timeRecordFormat the formats of the records describing a file.
+const (
+	fileRecordFormat = "C<mode> <size> <name> or D<mode> 0 <name>"
+	timeRecordFormat = "T<mtime> 0 <atime> 0"
+)
+
+// ProtocolError is returned when a record sent by the remote does not follow the scp protocol.
+// It holds the record as it was received, to find out what exactly the remote sent.
+type ProtocolError struct {
+	// Reason what is wrong with the record.
+	Reason string
+
+	// Line the record as it was received.
+	Line string
+
+	// Expected the format the record should follow.
+	Expected string
+
+	// Offset the position in `Line` in bytes, at which the record stops following the format.
+	Offset int
+
+	// Err the underlying error, such as failing to parse a number, if any.
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	message := fmt.Sprintf("%s at byte %d of %q, expected %q", e.Reason, e.Offset, e.Line, e.Expected)
+	if e.Err != nil {
+		message += ": " + e.Err.Error()
+	}
+	return message
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// ErrRemoteWarning matches the warnings sent by a remote scp, using errors.Is. The error
+// itself holds the message of the remote.
+var ErrRemoteWarning = errors.New("warning from the remote scp")
+
+// remoteWarning a warning sent by the remote scp, holding its message.
+type remoteWarning string
+
+func (w remoteWarning) Error() string {
+	return string(w)
+}
+
+func (w remoteWarning) Is(target error) bool {
+	return target == ErrRemoteWarning
+}
+
+// Protocol parses the records a remote scp sends along with the files it sends, so servers
+// whose scp deviates from the framing of OpenSSH can be supported by `Client.Protocol`.
+//
+// Implementations can embed OpenSSHProtocol to only override some of the methods. Note that
+// the ParseResponse method of OpenSSHProtocol parses the records itself, so an implementation
+// overriding ParseFileInfos or ParseFileTime should override ParseResponse as well.
+type Protocol interface {
+	// ParseResponse reads the next response of the remote when downloading a single file,
+	// see `ParseResponse`.
+	ParseResponse(reader io.Reader, writer io.Writer) (*FileInfos, error)
+
+	// ParseFileInfos parses a "C" or "D" record, see `ParseFileInfos`. It is used for the
+	// records of directory downloads.
+	ParseFileInfos(message string, fileInfos *FileInfos) error
+
+	// ParseFileTime parses a "T" record, see `ParseFileTime`. It is used for the records of
+	// directory downloads.
+	ParseFileTime(message string, fileInfos *FileInfos) error
+}
+
+// OpenSSHProtocol the scp protocol as spoken by OpenSSH, the default Protocol.
+type OpenSSHProtocol struct{}
+
+// ParseResponse see `ParseResponse`.
+func (OpenSSHProtocol) ParseResponse(reader io.Reader, writer io.Writer) (*FileInfos, error) {
+	return ParseResponse(reader, writer)
+}
+
+// ParseFileInfos see `ParseFileInfos`.
+func (OpenSSHProtocol) ParseFileInfos(message string, fileInfos *FileInfos) error {
+	return ParseFileInfos(message, fileInfos)
+}
+
+// ParseFileTime see `ParseFileTime`.
+func (OpenSSHProtocol) ParseFileTime(message string, fileInfos *FileInfos) error {
+	return ParseFileTime(message, fileInfos)
+}
+
 // ParseResponse reads from the given reader (assuming it is the output of the remote) and parses it into a Response structure.
 func ParseResponse(reader io.Reader, writer io.Writer) (*FileInfos, error) {
+	return parseResponse(reader, writer, "")
+}
+
+// parseResponse is like ParseResponse, but names `remotePath` in the error when a record
+// sent for it can not be parsed, unless it is empty.
+func parseResponse(reader io.Reader, writer io.Writer, remotePath string) (*FileInfos, error) {
 	fileInfos := NewFileInfos()
+	wrap := func(err error) error {
+		if remotePath == "" {
+			return err
+		}
+		return fmt.Errorf("file %q: %w", remotePath, err)
+	}
 
+	// A read may return no bytes without failing, so keep reading until there is one
 	buffer := make([]uint8, 1)
-	_, err := reader.Read(buffer)
+	_, err := io.ReadFull(reader, buffer)
 	if err != nil {
 		return fileInfos, err
 	}
@@ -44,7 +154,10 @@ func ParseResponse(reader io.Reader, writer io.Writer) (*FileInfos, error) {
 			return fileInfos, err
 		}
 
-		if responseType == Warning || responseType == Error {
+		if responseType == Warning {
+			return fileInfos, remoteWarning(message)
+		}
+		if responseType == Error {
 			return fileInfos, errors.New(message)
 		}
 
@@ -53,19 +166,22 @@ func ParseResponse(reader io.Reader, writer io.Writer) (*FileInfos, error) {
 			return fileInfos, nil
 		}
 
-		if !(responseType == Create || responseType == Time) {
-			return fileInfos, errors.New(
-				fmt.Sprintf(
-					"Message does not follow scp protocol: %s\n Cmmmm <length> <filename> or T<mtime> 0 <atime> 0",
-					message,
-				),
-			)
+		if responseType == EndDirectory {
+			return fileInfos, ErrEndDirectory
+		}
+
+		if !(responseType == Create || responseType == Directory || responseType == Time) {
+			return fileInfos, &ProtocolError{
+				Reason:   "unknown record type",
+				Line:     string(responseType) + message,
+				Expected: fileRecordFormat + " or " + timeRecordFormat,
+			}
 		}
 
 		if responseType == Time {
 			err = ParseFileTime(message, fileInfos)
 			if err != nil {
-				return nil, err
+				return nil, wrap(err)
 			}
 
 			// A custom ssh server can send both time, permissions and size information at once
@@ -79,19 +195,33 @@ func ParseResponse(reader io.Reader, writer io.Writer) (*FileInfos, error) {
 			}
 
 			message, err = bufferedReader.ReadString('\n')
-
+			if err == io.EOF && message == "" {
+				return fileInfos, fmt.Errorf("expected a file record after the time record: %w", io.ErrUnexpectedEOF)
+			}
 			if err != nil {
 				return fileInfos, err
 			}
 
+			if len(strings.TrimRight(message, "\n")) == 0 {
+				return fileInfos, errors.New("expected a file record after the time record, got an empty line")
+			}
+
 			responseType = message[0]
+			if !(responseType == Create || responseType == Directory) {
+				return fileInfos, fmt.Errorf("expected a file record after the time record, got: %q", message)
+			}
 		}
 
-		if responseType == Create {
+		if responseType == Create || responseType == Directory {
+			// Unless it followed a time record, the message lacks the response type
+			if message[0] != responseType {
+				message = string(responseType) + message
+			}
 			err = ParseFileInfos(message, fileInfos)
 			if err != nil {
-				return nil, err
+				return nil, wrap(err)
 			}
+			fileInfos.IsDir = responseType == Directory
 		}
 	}
 
@@ -105,12 +235,61 @@ type FileInfos struct {
 	Size        int64
 	Atime       int64
 	Mtime       int64
+
+	// IsDir whether the entry is a directory rather than a file.
+	IsDir bool
+
+	// Path the full remote path of the entry, only set when transferring or walking a directory tree.
+	Path string
 }
 
 func NewFileInfos() *FileInfos {
 	return &FileInfos{}
 }
 
+// Mode returns the permissions of the file as an os.FileMode, with the setuid, setgid and
+// sticky bits mapped onto their os.FileMode counterparts, and os.ModeDir set for directories.
+func (fileInfos *FileInfos) Mode() (os.FileMode, error) {
+	if fileInfos.Permissions > 07777 {
+		return 0, fmt.Errorf("invalid permissions %#o", fileInfos.Permissions)
+	}
+
+	mode, err := ParsePermissions(fmt.Sprintf("%04o", fileInfos.Permissions))
+	if err != nil {
+		return 0, err
+	}
+	if fileInfos.IsDir {
+		mode |= os.ModeDir
+	}
+	return mode, nil
+}
+
+// FileInfosFromStat describes a local file the same way the remote describes its files, so
+// it can be compared to the result of `StatRemote`. The access time can not be obtained
+// portably, so `Atime` is set to the modification time.
+func FileInfosFromStat(info os.FileInfo) *FileInfos {
+	fileInfos := &FileInfos{
+		Filename:    info.Name(),
+		Permissions: permissionBits(info.Mode()),
+		Mtime:       info.ModTime().Unix(),
+		Atime:       info.ModTime().Unix(),
+		IsDir:       info.IsDir(),
+	}
+	if !info.IsDir() {
+		fileInfos.Size = info.Size()
+	}
+	return fileInfos
+}
+
+// FileInfosFromPath describes the local file at `path` like `FileInfosFromStat`.
+func FileInfosFromPath(path string) (*FileInfos, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return FileInfosFromStat(info), nil
+}
+
 func (fileInfos *FileInfos) Update(new *FileInfos) {
 	if new == nil {
 		return
@@ -132,61 +311,39 @@ func (fileInfos *FileInfos) Update(new *FileInfos) {
 	}
 }
 
+// ParseFileInfos parses a "C" or "D" record, including its response type, into `fileInfos`.
+// It is parsed by `Command.UnmarshalText`.
 func ParseFileInfos(message string, fileInfos *FileInfos) error {
-	processMessage := strings.ReplaceAll(message, "\n", "")
-	parts := strings.Split(processMessage, " ")
-	if len(parts) < 3 {
-		return errors.New("unable to parse Chmod protocol")
-	}
-
-	permissions, err := strconv.ParseUint(parts[0][1:], 0, 32)
-	if err != nil {
+	var c Command
+	if err := c.UnmarshalText([]byte(message)); err != nil {
 		return err
 	}
-
-	size, err := strconv.ParseInt(parts[1], 10, 64)
-	if err != nil {
-		return err
+	if c.Type != Create && c.Type != Directory {
+		return &ProtocolError{Reason: "unexpected record type", Line: message, Expected: fileRecordFormat}
 	}
 
 	fileInfos.Update(&FileInfos{
-		Filename:    parts[2],
-		Permissions: uint32(permissions),
-		Size:        int64(size),
+		Filename:    c.Name,
+		Permissions: permissionBits(c.Mode),
+		Size:        c.Size,
 	})
-
 	return nil
 }
 
+// ParseFileTime parses a "T" record, without its response type, into `fileInfos`. It is
+// parsed the same way as by `Command.UnmarshalText`.
 func ParseFileTime(
 	message string,
 	fileInfos *FileInfos,
 ) error {
-	processMessage := strings.ReplaceAll(message, "\n", "")
-	parts := strings.Split(processMessage, " ")
-	if len(parts) < 3 {
-		return errors.New("unable to parse Time protocol")
-	}
-
-	if len(parts[0]) != 10 {
-		return errors.New("length of ATime is not 10")
-	}
-	mTime, err := strconv.Atoi(parts[0][0:10])
-	if err != nil {
-		return errors.New("unable to parse ATime component of message")
-	}
-
-	if len(parts[2]) != 10 {
-		return errors.New("length of MTime is not 10")
-	}
-	aTime, err := strconv.Atoi(parts[2][0:10])
-	if err != nil {
-		return errors.New("unable to parse MTime component of message")
+	var c Command
+	if err := c.unmarshalTime(message); err != nil {
+		return err
 	}
 
 	fileInfos.Update(&FileInfos{
-		Atime: int64(aTime),
-		Mtime: int64(mTime),
+		Atime: c.Atime.Unix(),
+		Mtime: c.Mtime.Unix(),
 	})
 	return nil
 }
@@ -204,3 +361,21 @@ func Ack(writer io.Writer) error {
 	}
 	return nil
 }
+
+// checkFileSize aborts the transfer of the file announced by the remote with ErrFileTooLarge
+// when it is larger than `maxSize`, unless `maxSize` is zero.
+func checkFileSize(writer io.Writer, remotePath string, fileInfos *FileInfos, maxSize int64) error {
+	if maxSize <= 0 || fileInfos.Size <= maxSize {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: %q has %d bytes, the maximum is %d", ErrFileTooLarge, remotePath, fileInfos.Size, maxSize)
+	abort(writer, err.Error())
+	return err
+}
+
+// abort writes a fatal error response to the remote, which makes it stop the transfer and exit.
+func abort(writer io.Writer, message string) error {
+	_, err := fmt.Fprintf(writer, "\x02%s\n", strings.ReplaceAll(message, "\n", " "))
+	return err
+}
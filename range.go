@@ -0,0 +1,53 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// CopyRangeFromRemote copies the bytes of the remote file at `remotePath` in the range
+// [`offset`, `offset`+`length`) to the given writer, and returns the number of bytes written.
+// Fewer bytes are written if the file ends before the end of the range, without an error.
+//
+// The scp protocol has no way to request part of a file, so the whole file is still transferred
+// over the wire: the bytes before and after the range are read from the remote and discarded.
+// This ensures the remote confirms it could read the whole file, and that its error is returned
+// otherwise. For a dry run, the remote file is checked with `StatRemote` and nothing is written.
+func (a *Client) CopyRangeFromRemote(
+	ctx context.Context,
+	w io.Writer,
+	remotePath string,
+	offset, length int64,
+	opts ...CallOption,
+) (int64, error) {
+	if offset < 0 || length < 0 {
+		return 0, fmt.Errorf("invalid range of %d bytes at offset %d: must not be negative", length, offset)
+	}
+
+	r, _, err := a.OpenRemote(ctx, remotePath, opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	if _, err := io.CopyN(io.Discard, r, offset); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	written, err := io.CopyN(w, r, length)
+	if err != nil && err != io.EOF {
+		return written, err
+	}
+
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return written, err
+	}
+	return written, r.Close()
+}
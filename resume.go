@@ -0,0 +1,214 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumeStateInterval the minimal amount of time between two updates of the resume state
+// while a file is uploaded.
+const resumeStateInterval = time.Second
+
+// resumeState is what is stored in the file at `Client.ResumeState`, describing an upload
+// of a local file that may have been interrupted.
+type resumeState struct {
+	RemotePath string    `json:"remotePath"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	Sent       int64     `json:"sent"`
+}
+
+// matches reports whether the state describes an upload of the same local file, which
+// has not been modified since, to the same remote path.
+func (s *resumeState) matches(remotePath string, stat os.FileInfo) bool {
+	return s.RemotePath == remotePath && s.Size == stat.Size() && s.ModTime.Equal(stat.ModTime())
+}
+
+// copyFromFileResumable uploads the file like `CopyPassThru`, resuming an earlier upload
+// of it recorded in the file at `ResumeState`, see `Client.ResumeState`.
+func (a *Client) copyFromFileResumable(
+	ctx context.Context,
+	file *os.File,
+	stat os.FileInfo,
+	remotePath string,
+	permissions string,
+	passThru PassThru,
+	opts ...CallOption,
+) error {
+	_, _, target, err := uploadTarget(remotePath, a.callOptions(opts).filename)
+	if err != nil {
+		return err
+	}
+
+	state, err := readResumeState(a.ResumeState)
+	if err != nil {
+		return err
+	}
+
+	if state != nil && state.matches(target, stat) {
+		info, err := a.StatRemote(ctx, target, opts...)
+		// The remote file may only hold bytes that were sent, see `Client.ResumeState`
+		if err == nil && !info.IsDir && info.Size > 0 && info.Size <= state.Sent && info.Size < stat.Size() {
+			return a.resumeUpload(ctx, file, target, info.Size, stat.Size(), passThru, opts...)
+		}
+	}
+
+	// Start over with an empty remote file, so an interrupted upload leaves only the
+	// bytes that were received in it
+	if err := a.CopyN(ctx, strings.NewReader(""), remotePath, permissions, 0, opts...); err != nil {
+		return err
+	}
+
+	state = &resumeState{RemotePath: target, Size: stat.Size(), ModTime: stat.ModTime()}
+	if err := writeResumeState(a.ResumeState, state); err != nil {
+		return err
+	}
+
+	recorder := &resumeRecorder{path: a.ResumeState, state: state, saved: time.Now()}
+	err = a.CopyPassThru(ctx, file, remotePath, permissions, stat.Size(), func(r io.Reader, total int64) io.Reader {
+		recorder.r = r
+		if passThru != nil {
+			return passThru(recorder, total)
+		}
+		return recorder
+	}, opts...)
+	if err != nil {
+		if saveErr := recorder.save(); saveErr != nil {
+			return errors.Join(err, saveErr)
+		}
+		return err
+	}
+
+	return removeResumeState(a.ResumeState)
+}
+
+// resumeUpload appends the part of the file from `offset` on to the remote file at `target`.
+func (a *Client) resumeUpload(
+	ctx context.Context,
+	file *os.File,
+	target string,
+	offset, size int64,
+	passThru PassThru,
+	opts ...CallOption,
+) error {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to offset %d to resume the upload: %w", offset, err)
+	}
+
+	var r io.Reader = file
+	if passThru != nil {
+		r = passThru(r, size-offset)
+	}
+
+	err := a.AppendToRemote(ctx, r, target, size-offset, opts...)
+	if done, ok := r.(PassThruDone); ok && passThru != nil {
+		done.Done(err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resume the upload at offset %d: %w", offset, err)
+	}
+
+	return removeResumeState(a.ResumeState)
+}
+
+// resumeRecorder counts the bytes read from the wrapped reader as sent, and saves them in the
+// resume state at most once every `resumeStateInterval`.
+type resumeRecorder struct {
+	r    io.Reader
+	path string
+
+	// Guards the state, which is saved once more after the transfer, when it may still be read
+	mu    sync.Mutex
+	state *resumeState
+	saved time.Time
+}
+
+func (r *resumeRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state.Sent += int64(n)
+	if time.Since(r.saved) >= resumeStateInterval {
+		r.saved = time.Now()
+		if saveErr := writeResumeState(r.path, r.state); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return n, err
+}
+
+// save stores the number of bytes sent until now in the resume state.
+func (r *resumeRecorder) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return writeResumeState(r.path, r.state)
+}
+
+// readResumeState reads the resume state stored in the file at `statePath`, it returns nil
+// if the file does not exist.
+func readResumeState(statePath string) (*resumeState, error) {
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the resume state: %w", err)
+	}
+
+	var state resumeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse the resume state in %q: %w", statePath, err)
+	}
+	return &state, nil
+}
+
+// writeResumeState stores the resume state in the file at `statePath`, replacing it as a
+// whole so it is never left half written.
+func writeResumeState(statePath string, state *resumeState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(statePath), filepath.Base(statePath)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write the resume state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), statePath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the resume state: %w", err)
+	}
+	return nil
+}
+
+// removeResumeState removes the resume state once the upload completed.
+func removeResumeState(statePath string) error {
+	if err := os.Remove(statePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove the resume state: %w", err)
+	}
+	return nil
+}
@@ -9,12 +9,34 @@
 package scp
 
 import (
+	"errors"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// ErrNilSSHClient is returned when a client is created from an SSH client that is nil.
+var ErrNilSSHClient = errors.New("ssh client is nil")
+
+// New returns a new scp.Client with provided host and ssh.ClientConfig. Unlike `NewClient` it
+// returns a pointer, so the connection state held by the client is never copied by accident.
+func New(host string, config *ssh.ClientConfig) *Client {
+	client := NewConfigurer(host, config).Create()
+	return &client
+}
+
+// NewBySSH returns a new scp.Client using an already existing established SSH connection,
+// like `NewClientBySSH` but as a pointer, see `New`.
+func NewBySSH(ssh *ssh.Client) (*Client, error) {
+	client, err := NewClientBySSH(ssh)
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
 // NewClient returns a new scp.Client with provided host and ssh.clientConfig.
+// Prefer `New`, as the client must not be copied once it is connected.
 func NewClient(host string, config *ssh.ClientConfig) Client {
 	return NewConfigurer(host, config).Create()
 }
@@ -26,12 +48,23 @@ func NewClientWithTimeout(host string, config *ssh.ClientConfig, timeout time.Du
 }
 
 // NewClientBySSH returns a new scp.Client using an already existing established SSH connection.
+// The SSH connection remains owned by the caller: closing the returned client does
+// not close it. An error is returned if the given SSH client is nil.
+// Prefer `NewBySSH`, as the client must not be copied once it is in use.
 func NewClientBySSH(ssh *ssh.Client) (Client, error) {
+	if ssh == nil {
+		return Client{}, ErrNilSSHClient
+	}
+
 	return NewConfigurer("", nil).SSHClient(ssh).Create(), nil
 }
 
 // NewClientBySSHWithTimeout same as NewClientWithTimeout but uses an existing SSH client.
 // Deprecated: provide meaningful context to each "Copy*" function instead.
 func NewClientBySSHWithTimeout(ssh *ssh.Client, timeout time.Duration) (Client, error) {
+	if ssh == nil {
+		return Client{}, ErrNilSSHClient
+	}
+
 	return NewConfigurer("", nil).SSHClient(ssh).Timeout(timeout).Create(), nil
 }
@@ -0,0 +1,100 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultMaxConcurrentSessions the default of `Client.MaxConcurrentSessions` for clients
+// created by the constructors.
+const defaultMaxConcurrentSessions = 1
+
+// sessionLimiter keeps track of the sessions open on a connection, so no more than
+// `MaxConcurrentSessions` are open at the same time.
+type sessionLimiter struct {
+	mu   sync.Mutex
+	open int
+
+	// Closed and replaced when a session is closed, waking up those waiting for one
+	closed chan struct{}
+}
+
+// acquire waits until fewer than `limit` sessions are open, unless `limit` is zero, and
+// counts the session about to be opened.
+func (l *sessionLimiter) acquire(ctx context.Context, limit int) error {
+	for {
+		l.mu.Lock()
+		if limit <= 0 || l.open < limit {
+			l.open++
+			l.mu.Unlock()
+			return nil
+		}
+		if l.closed == nil {
+			l.closed = make(chan struct{})
+		}
+		closed := l.closed
+		l.mu.Unlock()
+
+		select {
+		case <-closed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release counts a session as closed.
+func (l *sessionLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.open--
+	if l.closed != nil {
+		close(l.closed)
+		l.closed = nil
+	}
+}
+
+// openSession opens a new session on the connection, waiting for one of the sessions open
+// on it to be closed first when `MaxConcurrentSessions` are open. The session must be
+// closed with the returned function, which may be called multiple times.
+func (a *Client) openSession(ctx context.Context) (*ssh.Session, func(), error) {
+	sshClient, _ := a.connection()
+	if sshClient == nil {
+		return nil, nil, ErrNotConnected
+	}
+
+	sessions := a.sessions
+	if sessions != nil {
+		if err := sessions.acquire(ctx, a.MaxConcurrentSessions); err != nil {
+			return nil, nil, err
+		}
+	}
+	release := func() {
+		if sessions != nil {
+			sessions.release()
+		}
+	}
+
+	session, err := sshClient.NewSession()
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	return session, func() {
+		once.Do(func() {
+			session.Close()
+			release()
+		})
+	}, nil
+}
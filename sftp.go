@@ -0,0 +1,507 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// This file implements the small part of version 3 of the SFTP protocol needed to transfer
+// a single file, which is used when the remote has no scp binary and `SFTPFallback` is set.
+
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpFstat    = 8
+	sftpFsetstat = 10
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpAttrs    = 105
+)
+
+const (
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+)
+
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrTimes       = 0x08
+)
+
+const (
+	sftpStatusOK  = 0
+	sftpStatusEOF = 1
+)
+
+// sftpChunkSize the number of bytes read or written by a single request.
+const sftpChunkSize = 32 * 1024
+
+// missingBinary reports whether the error is from a remote scp binary that could not be found,
+// which the remote shell reports with exit status 127. When scp is run through a wrapper such
+// as "sudo -n scp", the status may be from the wrapper itself missing instead, so the standard
+// error must name the scp binary, falling back to SFTP would bypass the wrapper otherwise.
+func (o callOptions) missingBinary(err error) bool {
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 127 {
+		return false
+	}
+	if len(o.remoteCommand) <= 1 {
+		return true
+	}
+
+	var remoteErr *RemoteError
+	binary := o.remoteCommand[len(o.remoteCommand)-1]
+	return errors.As(err, &remoteErr) && strings.Contains(remoteErr.Stderr, binary+":")
+}
+
+// sftpStatusError an SFTP request that failed.
+type sftpStatusError struct {
+	code    uint32
+	message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.message, e.code)
+}
+
+// sftpAttributes the attributes of a remote file, as far as they are used by this package.
+type sftpAttributes struct {
+	size        int64
+	permissions uint32
+	atime       int64
+	mtime       int64
+}
+
+// sftpConn a connection to the SFTP subsystem of the remote, sending one request at a time.
+type sftpConn struct {
+	w      io.Writer
+	r      io.Reader
+	nextID uint32
+}
+
+// sftpUpload uploads a file over SFTP, for when the remote has no scp binary.
+func (a *Client) sftpUpload(
+	ctx context.Context,
+	r io.Reader,
+	remotePath string,
+	mode os.FileMode,
+	size int64,
+	mtime time.Time,
+	atime time.Time,
+) error {
+	return a.withSFTP(ctx, func(ctx context.Context, conn *sftpConn) error {
+		handle, err := conn.open(remotePath, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc, permissionBits(a.maskPermissions(mode)))
+		if err != nil {
+			return err
+		}
+
+		r, finish := a.trackTransfer(remotePath, size, r)
+		err = conn.writeAll(handle, contextReader{ctx: ctx, r: r}, size)
+		finish(err)
+		if err == nil && !mtime.IsZero() {
+			if atime.IsZero() {
+				atime = mtime
+			}
+			err = conn.setTimes(handle, mtime, atime)
+		}
+		if closeErr := conn.close(handle); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+}
+
+// sftpDownload downloads a file over SFTP, for when the remote has no scp binary.
+func (a *Client) sftpDownload(
+	ctx context.Context,
+	w io.Writer,
+	remotePath string,
+	passThru PassThru,
+) (*FileInfos, int64, error) {
+	var fileInfos *FileInfos
+	var written int64
+
+	err := a.withSFTP(ctx, func(ctx context.Context, conn *sftpConn) error {
+		handle, err := conn.open(remotePath, sftpFlagRead, 0)
+		if err != nil {
+			return err
+		}
+		defer conn.close(handle)
+
+		attrs, err := conn.fstat(handle)
+		if err != nil {
+			return err
+		}
+		if attrs.permissions&0170000 == 0040000 {
+			return ErrIsDirectory
+		}
+
+		fileInfos = &FileInfos{
+			Filename:    path.Base(remotePath),
+			Permissions: attrs.permissions & 07777,
+			Size:        attrs.size,
+			Atime:       attrs.atime,
+			Mtime:       attrs.mtime,
+		}
+
+		// Nothing is sent before the contents are requested, closing the file is enough to abort
+		if err := checkFileSize(io.Discard, remotePath, fileInfos, a.MaxFileSize); err != nil {
+			return err
+		}
+
+		var r io.Reader = &sftpReader{conn: conn, handle: handle}
+		if passThru != nil {
+			r = passThru(r, attrs.size)
+			if done, ok := r.(PassThruDone); ok {
+				defer func() { done.Done(err) }()
+			}
+		}
+
+		r, finish := a.trackTransfer(remotePath, attrs.size, r)
+		defer func() { finish(err) }()
+
+		written, err = a.copyContents(ctx, w, r, attrs.size)
+		return err
+	})
+
+	return fileInfos, written, err
+}
+
+// withSFTP starts the SFTP subsystem on the remote and calls `fn` with a connection to it.
+// The subsystem is stopped as soon as the context is done.
+func (a *Client) withSFTP(ctx context.Context, fn func(ctx context.Context, conn *sftpConn) error) error {
+	if err := a.checkConnection(ctx); err != nil {
+		return err
+	}
+
+	session, closeSession, err := a.openSession(ctx)
+	if err != nil {
+		return fmt.Errorf("Error creating ssh session for sftp: %w", err)
+	}
+	defer closeSession()
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return fmt.Errorf("failed to start the sftp subsystem: %w", err)
+	}
+
+	ctx, cancelTimeout := a.transferContext(ctx)
+	defer cancelTimeout()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn := &sftpConn{w: w, r: r}
+		if err := conn.init(); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- fn(ctx, conn)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// init negotiates the protocol version with the remote.
+func (c *sftpConn) init() error {
+	packet := []byte{sftpInit}
+	packet = binary.BigEndian.AppendUint32(packet, 3)
+	if err := c.send(packet); err != nil {
+		return err
+	}
+
+	packetType, _, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if packetType != sftpVersion {
+		return fmt.Errorf("sftp: unexpected packet type %d, expected version", packetType)
+	}
+	return nil
+}
+
+// open opens the remote file, creating it with the given permissions if needed.
+func (c *sftpConn) open(remotePath string, flags uint32, permissions uint32) (string, error) {
+	packet := c.request(sftpOpen)
+	packet = appendString(packet, remotePath)
+	packet = binary.BigEndian.AppendUint32(packet, flags)
+	if flags&sftpFlagCreat != 0 {
+		packet = binary.BigEndian.AppendUint32(packet, sftpAttrPermissions)
+		packet = binary.BigEndian.AppendUint32(packet, permissions)
+	} else {
+		packet = binary.BigEndian.AppendUint32(packet, 0)
+	}
+
+	payload, err := c.call(packet, sftpHandle)
+	if err != nil {
+		return "", err
+	}
+
+	handle, _, err := readString(payload)
+	return handle, err
+}
+
+// close closes the remote file.
+func (c *sftpConn) close(handle string) error {
+	packet := c.request(sftpClose)
+	packet = appendString(packet, handle)
+	_, err := c.call(packet, sftpStatus)
+	return err
+}
+
+// writeAll writes exactly `size` bytes from the reader to the remote file.
+func (c *sftpConn) writeAll(handle string, r io.Reader, size int64) error {
+	buffer := make([]byte, sftpChunkSize)
+	var offset int64
+	for offset < size {
+		chunk := buffer
+		if size-offset < int64(len(chunk)) {
+			chunk = chunk[:size-offset]
+		}
+
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			packet := c.request(sftpWrite)
+			packet = appendString(packet, handle)
+			packet = binary.BigEndian.AppendUint64(packet, uint64(offset))
+			packet = appendString(packet, string(chunk[:n]))
+			if _, err := c.call(packet, sftpStatus); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: expected %d bytes, sent %d", ErrShortRead, size, offset)
+		}
+		if err != nil {
+			return fmt.Errorf("expected %d bytes, sent %d: %w", size, offset, err)
+		}
+	}
+	return nil
+}
+
+// setTimes sets the modification and access time of the remote file.
+func (c *sftpConn) setTimes(handle string, mtime, atime time.Time) error {
+	packet := c.request(sftpFsetstat)
+	packet = appendString(packet, handle)
+	packet = binary.BigEndian.AppendUint32(packet, sftpAttrTimes)
+	packet = binary.BigEndian.AppendUint32(packet, uint32(atime.Unix()))
+	packet = binary.BigEndian.AppendUint32(packet, uint32(mtime.Unix()))
+	_, err := c.call(packet, sftpStatus)
+	return err
+}
+
+// fstat returns the attributes of the remote file.
+func (c *sftpConn) fstat(handle string) (*sftpAttributes, error) {
+	packet := c.request(sftpFstat)
+	packet = appendString(packet, handle)
+	payload, err := c.call(packet, sftpAttrs)
+	if err != nil {
+		return nil, err
+	}
+	return parseAttributes(payload)
+}
+
+// sftpReader reads a remote file sequentially.
+type sftpReader struct {
+	conn   *sftpConn
+	handle string
+	offset int64
+}
+
+func (s *sftpReader) Read(p []byte) (int, error) {
+	if len(p) > sftpChunkSize {
+		p = p[:sftpChunkSize]
+	}
+
+	packet := s.conn.request(sftpRead)
+	packet = appendString(packet, s.handle)
+	packet = binary.BigEndian.AppendUint64(packet, uint64(s.offset))
+	packet = binary.BigEndian.AppendUint32(packet, uint32(len(p)))
+
+	payload, err := s.conn.call(packet, sftpData)
+	var statusErr *sftpStatusError
+	if errors.As(err, &statusErr) && statusErr.code == sftpStatusEOF {
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	data, _, err := readString(payload)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	s.offset += int64(n)
+	return n, nil
+}
+
+// request starts a request packet of the given type with the next request id.
+func (c *sftpConn) request(packetType byte) []byte {
+	c.nextID++
+	return binary.BigEndian.AppendUint32([]byte{packetType}, c.nextID)
+}
+
+// call sends the request and returns the payload of the response after the request id,
+// which must be of the expected type. A status response that is not OK is returned as error.
+func (c *sftpConn) call(packet []byte, expected byte) ([]byte, error) {
+	if err := c.send(packet); err != nil {
+		return nil, err
+	}
+
+	packetType, payload, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 4 {
+		return nil, errors.New("sftp: response is too short")
+	}
+	payload = payload[4:]
+
+	if packetType == sftpStatus {
+		if len(payload) < 4 {
+			return nil, errors.New("sftp: status response is too short")
+		}
+		code := binary.BigEndian.Uint32(payload)
+		message, _, _ := readString(payload[4:])
+		if code != sftpStatusOK {
+			return nil, &sftpStatusError{code: code, message: message}
+		}
+		if expected != sftpStatus {
+			return nil, fmt.Errorf("sftp: unexpected status response, expected packet type %d", expected)
+		}
+		return nil, nil
+	}
+
+	if packetType != expected {
+		return nil, fmt.Errorf("sftp: unexpected packet type %d, expected %d", packetType, expected)
+	}
+	return payload, nil
+}
+
+// send sends a packet, prefixed with its length.
+func (c *sftpConn) send(packet []byte) error {
+	_, err := c.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(packet))))
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(packet)
+	return err
+}
+
+// receive reads a packet and returns its type and the rest of its contents.
+func (c *sftpConn) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	if length == 0 || length > 256*1024 {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", length)
+	}
+
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// parseAttributes parses the attributes of a file sent by the remote.
+func parseAttributes(b []byte) (*sftpAttributes, error) {
+	errShort := errors.New("sftp: attributes are too short")
+	attrs := &sftpAttributes{}
+
+	if len(b) < 4 {
+		return nil, errShort
+	}
+	flags := binary.BigEndian.Uint32(b)
+	b = b[4:]
+
+	if flags&sftpAttrSize != 0 {
+		if len(b) < 8 {
+			return nil, errShort
+		}
+		attrs.size = int64(binary.BigEndian.Uint64(b))
+		b = b[8:]
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		if len(b) < 8 {
+			return nil, errShort
+		}
+		b = b[8:]
+	}
+	if flags&sftpAttrPermissions != 0 {
+		if len(b) < 4 {
+			return nil, errShort
+		}
+		attrs.permissions = binary.BigEndian.Uint32(b)
+		b = b[4:]
+	}
+	if flags&sftpAttrTimes != 0 {
+		if len(b) < 8 {
+			return nil, errShort
+		}
+		attrs.atime = int64(binary.BigEndian.Uint32(b))
+		attrs.mtime = int64(binary.BigEndian.Uint32(b[4:]))
+	}
+
+	return attrs, nil
+}
+
+// appendString appends a string prefixed with its length.
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// readString reads a string prefixed with its length, and returns the rest of the bytes.
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("sftp: string is too short")
+	}
+	length := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < length {
+		return "", nil, errors.New("sftp: string is too short")
+	}
+	return string(b[4 : 4+length]), b[4+length:], nil
+}
@@ -0,0 +1,59 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CopyStream copies the contents of a reader of unknown length, such as the output of a
+// command, to a remote location. As scp needs to announce the size of a file before sending
+// it, the reader is first spooled to a temporary file on the local disk, which is then
+// streamed to the remote and removed afterwards. Unlike `CopyFile`, this keeps memory usage
+// bounded no matter how much the reader yields, at the cost of local disk space.
+//
+// The temporary file is created in the directory returned by os.TempDir. Nothing is read
+// from the reader for a dry run.
+func (a *Client) CopyStream(
+	ctx context.Context,
+	r io.Reader,
+	remotePath string,
+	permissions string,
+	opts ...CallOption,
+) error {
+	if _, err := ParsePermissions(permissions); err != nil {
+		return err
+	}
+
+	if a.DryRun {
+		return a.CopyN(ctx, r, remotePath, permissions, 0, opts...)
+	}
+
+	spool, err := os.CreateTemp("", "go-scp-stream-*")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file to spool the stream: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := copyBuffer(spool, contextReader{ctx: ctx, r: r}, a.BufferSize)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to spool the stream to %q: %w", spool.Name(), err)
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return a.CopyN(ctx, spool, remotePath, permissions, size, opts...)
+}
@@ -0,0 +1,47 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrRemoteSymlink is returned when `RefuseSymlinks` is set and the remote path an upload
+// would write to is a symbolic link.
+var ErrRemoteSymlink = errors.New("remote path is a symbolic link")
+
+// checkNotSymlinks returns ErrRemoteSymlink if any of the remote paths is a symbolic link,
+// when `RefuseSymlinks` is set.
+func (a *Client) checkNotSymlinks(ctx context.Context, remotePaths ...string) error {
+	if !a.RefuseSymlinks || len(remotePaths) == 0 {
+		return nil
+	}
+
+	quoted := make([]string, len(remotePaths))
+	for i, remotePath := range remotePaths {
+		if err := a.checkRemotePath(remotePath); err != nil {
+			return err
+		}
+		quoted[i] = quoteShell(remotePath)
+	}
+
+	output, err := a.runRemote(ctx, fmt.Sprintf(
+		`for p in %s; do if test -L "$p"; then printf '%%s\n' "$p"; fi; done`,
+		strings.Join(quoted, " "),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to check the remote paths for symbolic links: %w", err)
+	}
+
+	if symlinks := strings.TrimSuffix(string(output), "\n"); symlinks != "" {
+		return fmt.Errorf("%w: %q", ErrRemoteSymlink, strings.Split(symlinks, "\n")[0])
+	}
+	return nil
+}
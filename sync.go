@@ -0,0 +1,224 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SyncOptions the options for mirroring a local directory to the remote with `SyncToRemote`.
+type SyncOptions struct {
+	// Delete removes the remote files and directories that do not exist locally.
+	// Deleting runs `rm -rf` on the remote, which requires a remote shell.
+	Delete bool
+
+	// DryRun reports what would be uploaded and deleted without changing anything on the
+	// remote. Setting `DryRun` on the client has the same effect.
+	DryRun bool
+
+	// Progress when set, is called to report on the progress of the files being uploaded.
+	Progress DirProgress
+}
+
+// SyncReport tallies what `SyncToRemote` did, or would have done for a dry run.
+type SyncReport struct {
+	// Uploaded the number of files that were new or changed and have been uploaded.
+	Uploaded int
+
+	// Skipped the number of files that were unchanged and have not been uploaded.
+	Skipped int
+
+	// Deleted the number of remote files that did not exist locally and have been
+	// deleted, including the files in deleted directories.
+	Deleted int
+}
+
+// SyncToRemote mirrors the local directory `localDir` to the remote directory `remoteDir`,
+// only uploading the files that are new or changed. `remoteDir` is created if it does not
+// exist yet, its parent must exist. Symbolic links and other special files are skipped.
+//
+// The remote tree is listed with `WalkRemote`, which makes the remote send the contents of
+// all its files, so listing a large tree takes as long as downloading it. A file is
+// considered changed when its size differs from the remote file, or when it was modified
+// after the remote file. Uploads do not preserve modification times, so an uploaded file
+// is newer than its local copy and is skipped by the next sync.
+//
+// A path that is a file on one side and a directory on the other is reported as an error.
+// On error, the report tallies what was done so far.
+func (a *Client) SyncToRemote(ctx context.Context, localDir, remoteDir string, opts SyncOptions, callOpts ...CallOption) (SyncReport, error) {
+	var report SyncReport
+
+	remoteDir, err := a.expandTilde(ctx, remoteDir)
+	if err != nil {
+		return report, err
+	}
+	root := path.Clean(remoteDir)
+
+	dirname := path.Base(root)
+	if dirname == "/" || dirname == "." || dirname == ".." {
+		return report, fmt.Errorf("invalid remote directory: %q", remoteDir)
+	}
+
+	info, err := os.Stat(localDir)
+	if err != nil {
+		return report, err
+	}
+	if !info.IsDir() {
+		return report, fmt.Errorf("local path %q is not a directory", localDir)
+	}
+
+	if err := a.checkNotSymlinks(ctx, root); err != nil {
+		return report, err
+	}
+
+	remote, err := a.listRemoteTree(ctx, root, callOpts...)
+	if err != nil {
+		return report, err
+	}
+
+	// Find the local files and directories, and which of them need to be sent
+	local := make(map[string]bool)
+	changed := make(map[string]bool)
+	missingDir := false
+	err = filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		remotePath := path.Join(root, filepath.ToSlash(rel))
+		local[remotePath] = true
+
+		remoteInfo, exists := remote.entries[remotePath]
+		if exists && remoteInfo.IsDir != d.IsDir() {
+			return fmt.Errorf("%q is a directory on one side and a file on the other", remotePath)
+		}
+
+		if d.IsDir() {
+			missingDir = missingDir || !exists
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if exists && remoteInfo.Size == info.Size() && info.ModTime().Unix() <= remoteInfo.Mtime {
+			report.Skipped++
+			return nil
+		}
+		changed[remotePath] = true
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	dryRun := opts.DryRun || a.DryRun
+
+	if len(changed) > 0 || missingDir {
+		if !dryRun {
+			err := a.sendTree(ctx, localDir, root, info.Mode(), &DirOptions{Progress: opts.Progress}, func(remotePath string) bool {
+				return changed[remotePath]
+			}, callOpts...)
+			if err != nil {
+				return report, err
+			}
+		}
+		report.Uploaded = len(changed)
+	}
+
+	if !opts.Delete {
+		return report, nil
+	}
+
+	// The remote tree is listed before its contents, so a directory is always
+	// seen before the entries in it, which are deleted along with it
+	var deletions []string
+	deletedDirs := make(map[string]bool)
+	deleted := 0
+	for _, remotePath := range remote.order {
+		if local[remotePath] {
+			continue
+		}
+		if !deletedDirs[path.Dir(remotePath)] {
+			deletions = append(deletions, remotePath)
+		}
+		if remote.entries[remotePath].IsDir {
+			deletedDirs[remotePath] = true
+		} else {
+			deleted++
+		}
+	}
+
+	if len(deletions) > 0 && !dryRun {
+		quoted := make([]string, len(deletions))
+		for i, remotePath := range deletions {
+			quoted[i] = quoteShell(remotePath)
+		}
+		command := fmt.Sprintf(
+			"%srm -rf -- %s",
+			a.callOptions(callOpts).commandPrefix(),
+			strings.Join(quoted, " "),
+		)
+		if _, err := a.runRemote(ctx, command); err != nil {
+			return report, fmt.Errorf("failed to delete remote files: %w", err)
+		}
+	}
+	report.Deleted = deleted
+
+	return report, nil
+}
+
+// remoteTree the entries of a remote directory tree by their remote path, including the
+// directory itself, along with the order in which the entries below it were listed.
+type remoteTree struct {
+	entries map[string]FileInfos
+	order   []string
+}
+
+// listRemoteTree lists the entries below the remote directory `root`, which is empty when
+// `root` does not exist.
+func (a *Client) listRemoteTree(ctx context.Context, root string, callOpts ...CallOption) (*remoteTree, error) {
+	tree := &remoteTree{entries: make(map[string]FileInfos)}
+	err := a.WalkRemote(ctx, root, func(info FileInfos) error {
+		tree.entries[info.Path] = info
+		if info.Path != root {
+			tree.order = append(tree.order, info.Path)
+		}
+		return nil
+	}, callOpts...)
+	if err == nil {
+		return tree, nil
+	}
+	if errors.Is(err, ErrNotDirectory) {
+		return nil, err
+	}
+
+	// Only a missing directory can be synced to, ask the remote whether that is the case
+	var exitErr *ssh.ExitError
+	_, testErr := a.runRemote(ctx, "test -e "+quoteShell(root))
+	if errors.As(testErr, &exitErr) && exitErr.ExitStatus() == 1 && len(tree.entries) == 0 {
+		return tree, nil
+	}
+	return nil, err
+}
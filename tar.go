@@ -0,0 +1,124 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// CopyTarToRemote extracts the tar stream read from `tarReader` into the existing remote
+// directory `remoteDir`, by piping it into `tar -x` on the remote. Sending many small files
+// this way is much faster than with `CopyDirToRemote`, as it uses a single session and
+// bypasses the scp protocol, which waits for the remote to confirm every file.
+//
+// This requires a remote shell and `tar` on the remote. When the remote scp binary is run
+// through a wrapper such as "sudo scp", `tar` is run through the same wrapper. A RemoteError
+// holding the output of `tar` is returned if it fails. For a dry run only the remote
+// directory is checked, and nothing is read from the reader.
+func (a *Client) CopyTarToRemote(ctx context.Context, tarReader io.Reader, remoteDir string, opts ...CallOption) error {
+	remoteDir, err := a.expandTilde(ctx, remoteDir)
+	if err != nil {
+		return err
+	}
+
+	if err := a.checkRemotePath(remoteDir); err != nil {
+		return err
+	}
+
+	if a.DryRun {
+		return a.checkWritable(ctx, remoteDir)
+	}
+
+	if err := a.checkNotSymlinks(ctx, remoteDir); err != nil {
+		return err
+	}
+
+	ctx, cancelTimeout := a.transferContext(ctx)
+	defer cancelTimeout()
+
+	command := fmt.Sprintf("%star -x -C %s", a.callOptions(opts).commandPrefix(), quoteShell(remoteDir))
+	_, err = a.runRemoteInput(ctx, command, contextReader{ctx: ctx, r: tarReader})
+	if err != nil {
+		return fmt.Errorf("failed to extract the tar stream into %q: %w", remoteDir, err)
+	}
+	return nil
+}
+
+// CopyTarFromRemote writes a tar stream of the contents of the remote directory `remoteDir`
+// to the given writer, by running `tar -c` on the remote. The entries in the stream are
+// relative to `remoteDir`. Like `CopyTarToRemote`, this requires a remote shell and `tar`
+// on the remote, and is run through the same wrapper as the remote scp binary.
+//
+// A RemoteError holding the output of `tar` is returned if it fails, in which case the
+// stream written until then is incomplete. For a dry run only the remote directory is
+// checked with `StatRemote`, and nothing is written.
+func (a *Client) CopyTarFromRemote(ctx context.Context, w io.Writer, remoteDir string, opts ...CallOption) error {
+	remoteDir, err := a.expandTilde(ctx, remoteDir)
+	if err != nil {
+		return err
+	}
+
+	if err := a.checkRemotePath(remoteDir); err != nil {
+		return err
+	}
+
+	if a.DryRun {
+		info, err := a.StatRemote(ctx, remoteDir, opts...)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir {
+			return ErrNotDirectory
+		}
+		return nil
+	}
+
+	if err := a.checkConnection(ctx); err != nil {
+		return err
+	}
+
+	session, closeSession, err := a.openSession(ctx)
+	if err != nil {
+		return fmt.Errorf("Error creating ssh session in copy tar from remote: %w", err)
+	}
+	defer closeSession()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := captureStderr(session)
+	if err != nil {
+		return err
+	}
+
+	command := fmt.Sprintf("%star -c -C %s .", a.callOptions(opts).commandPrefix(), quoteShell(remoteDir))
+	if err := session.Start(command); err != nil {
+		return err
+	}
+
+	// Closing the session ends the copy below, so nothing is written once we returned
+	ctx, cancelTimeout := a.transferContext(ctx)
+	defer cancelTimeout()
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	defer stop()
+
+	_, err = copyBuffer(w, stdout, a.BufferSize)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write the tar stream of %q: %w", remoteDir, err)
+	}
+
+	if err := session.Wait(); err != nil {
+		return &RemoteError{Err: err, Stderr: stderr()}
+	}
+	return nil
+}
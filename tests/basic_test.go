@@ -1,17 +1,31 @@
 package scp
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bramvdbogaerde/go-scp"
 	"github.com/bramvdbogaerde/go-scp/auth"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // password | private key | private key with passphrase | ssh agent
@@ -61,6 +75,48 @@ func establishConnection(t *testing.T) scp.Client {
 	return client
 }
 
+// TestConnectTimeout tests that connecting to an address that never answers
+// gives up after the connect timeout.
+func TestConnectTimeout(t *testing.T) {
+	clientConfig, err := buildClientConfig()
+	if err != nil {
+		t.Fatalf("Couldn't build the client configuration: %s", err)
+	}
+
+	// Addresses in this range are not routed, so the connection attempt hangs.
+	client := scp.NewClient("10.255.255.1:22", &clientConfig)
+	client.ConnectTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err = client.Connect()
+	if err == nil {
+		t.Errorf("Expected error thrown. Got nil")
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Connecting took %s, expected it to time out", elapsed)
+	}
+}
+
+// TestConnectContextCancel tests that a connection attempt is given up when
+// the context is cancelled.
+func TestConnectContextCancel(t *testing.T) {
+	clientConfig, err := buildClientConfig()
+	if err != nil {
+		t.Fatalf("Couldn't build the client configuration: %s", err)
+	}
+
+	client := scp.NewClient("127.0.0.1:2244", &clientConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = client.ConnectContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("Expected a canceled error but got %v", err)
+	}
+}
+
 // TestCopy tests the basic functionality of copying a file to the remote
 // destination.
 //
@@ -100,6 +156,85 @@ func TestCopy(t *testing.T) {
 	}
 }
 
+// TestCopyShellSpecialCharacters tests that remote paths containing characters
+// that are special to the remote shell are transferred verbatim, both when
+// uploading and when downloading.
+func TestCopyShellSpecialCharacters(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	filenames := []string{
+		"file with spaces.txt",
+		"file with 'single' quotes.txt",
+		"file with $HOME and ${PATH}.txt",
+		"file with `echo backticks`.txt",
+		"file with \\backslash\\x00.txt",
+	}
+
+	for _, filename := range filenames {
+		f, _ := os.Open("./data/upload_file.txt")
+
+		err := client.CopyFile(context.Background(), f, "/data/"+filename, "0777")
+		f.Close()
+		if err != nil {
+			t.Errorf("Error while copying file %q: %s", filename, err)
+			continue
+		}
+
+		content, err := os.ReadFile("./tmp/" + filename)
+		if err != nil {
+			t.Errorf("Result file %q could not be read: %s", filename, err)
+			continue
+		}
+
+		text := string(content)
+		expected := "It Works\n"
+		if strings.Compare(text, expected) != 0 {
+			t.Errorf("Got different text than expected, expected %q got, %q", expected, text)
+		}
+
+		var buf strings.Builder
+		err = client.CopyFromRemotePassThru(context.Background(), &buf, "/data/"+filename, nil)
+		if err != nil {
+			t.Errorf("Copy failed from remote for %q: %s", filename, err)
+			continue
+		}
+
+		if strings.Compare(buf.String(), expected) != 0 {
+			t.Errorf("Got different text than expected, expected %q got, %q", expected, buf.String())
+		}
+	}
+}
+
+// TestUploadFile tests copying a local file to the remote by its path, using
+// the permissions of the local file.
+func TestUploadFile(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	err := client.UploadFile(context.Background(), "./data/upload_file.txt", "/data/uploaded_by_path.txt", 0)
+	if err != nil {
+		t.Errorf("Error while copying file: %s", err)
+	}
+
+	content, err := os.ReadFile("./tmp/uploaded_by_path.txt")
+	if err != nil {
+		t.Errorf("Result file could not be read: %s", err)
+	}
+
+	text := string(content)
+	expected := "It Works\n"
+	if strings.Compare(text, expected) != 0 {
+		t.Errorf("Got different text than expected, expected %q got, %q", expected, text)
+	}
+
+	localStat, _ := os.Stat("./data/upload_file.txt")
+	remoteStat, _ := os.Stat("./tmp/uploaded_by_path.txt")
+	if localStat.Mode().Perm() != remoteStat.Mode().Perm() {
+		t.Errorf("File permissions don't match %s vs %s", localStat.Mode().Perm(), remoteStat.Mode().Perm())
+	}
+}
+
 // TestCopy tests the basic functionality of copying a file to the remote
 // destination.
 //
@@ -189,6 +324,80 @@ func TestMultipleUploadsAndDownloads(t *testing.T) {
 
 }
 
+// TestCopyFilesToDir tests that multiple files can be uploaded to a directory in one session.
+func TestCopyFilesToDir(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	contents := map[string]string{
+		"batch_1.txt":       "It Works\n",
+		"batch 2 ø.txt":     "Here is some stuff and things.\n",
+		"batch_3_empty.txt": "",
+	}
+
+	var files []scp.NamedReader
+	for name, content := range contents {
+		files = append(files, scp.NamedReader{
+			Name:        name,
+			Reader:      strings.NewReader(content),
+			Size:        int64(len(content)),
+			Permissions: "0644",
+		})
+	}
+
+	err := client.CopyFilesToDir(context.Background(), "/data", files)
+	if err != nil {
+		t.Errorf("Error while copying files: %s", err)
+	}
+
+	for name, expected := range contents {
+		content, err := os.ReadFile("./tmp/" + name)
+		if err != nil {
+			t.Errorf("Result file could not be read: %s", err)
+		}
+
+		text := string(content)
+		if strings.Compare(text, expected) != 0 {
+			t.Errorf("Got different text than expected, expected %q got, %q", expected, text)
+		}
+	}
+}
+
+// TestCopyFileInfos tests that the metadata recorded by the remote is returned after an upload.
+func TestCopyFileInfos(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	content := "It Works\n"
+	fileInfos, err := client.CopyFileInfos(
+		context.Background(),
+		strings.NewReader(content),
+		"/data/file_infos.txt",
+		"0640",
+		int64(len(content)),
+	)
+	if err != nil {
+		t.Errorf("Error while copying file: %s", err)
+	}
+
+	fileStat, err := os.Stat("./tmp/file_infos.txt")
+	if err != nil {
+		t.Errorf("Result file could not be read: %s", err)
+	}
+
+	if fileInfos.Size != fileStat.Size() {
+		t.Errorf("File size does not match")
+	}
+
+	if fileInfos.Mtime != fileStat.ModTime().Unix() {
+		t.Errorf("File modification time does not match %d vs %d", fileInfos.Mtime, fileStat.ModTime().Unix())
+	}
+
+	if fileInfos.Permissions != 0640 {
+		t.Errorf("File permissions don't match %o vs 0640", fileInfos.Permissions)
+	}
+}
+
 func upload(client *scp.Client, file *os.File, remoteFilename, perm string) error {
 	return client.CopyFile(context.Background(), file, remoteFilename, "0777")
 }
@@ -234,6 +443,94 @@ func TestDownloadFile(t *testing.T) {
 	}
 }
 
+// TestDownloadFileToPath tests that DownloadFile creates the local file
+// itself, and removes it again when the transfer fails.
+func TestDownloadFileToPath(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	err := client.DownloadFile(
+		context.Background(),
+		"/input/Exöt1ç download file.txt.txt",
+		"./tmp/output_path.txt",
+		0644,
+	)
+	if err != nil {
+		t.Errorf("Copy failed from remote: %s", err.Error())
+	}
+
+	content, err := os.ReadFile("./tmp/output_path.txt")
+	if err != nil {
+		t.Errorf("Result file could not be read: %s", err)
+	}
+
+	text := string(content)
+	expected := "It works for download!\n"
+	if strings.Compare(text, expected) != 0 {
+		t.Errorf("Got different text than expected, expected %q got, %q", expected, text)
+	}
+
+	err = client.DownloadFile(
+		context.Background(),
+		"/input/no_such_file.txt",
+		"./tmp/output_path_fnf.txt",
+		0644,
+	)
+	if err == nil {
+		t.Errorf("Expected error thrown. Got nil")
+	}
+
+	if _, err := os.Stat("./tmp/output_path_fnf.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected partial file to be removed, got %v", err)
+	}
+}
+
+// TestDownloadFileCount tests that the number of downloaded bytes is reported.
+func TestDownloadFileCount(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	var buf strings.Builder
+	n, err := client.CopyFromRemoteCount(context.Background(), &buf, "/input/Exöt1ç download file.txt.txt", nil)
+	if err != nil {
+		t.Errorf("Copy failed from remote: %s", err.Error())
+	}
+
+	if n != int64(buf.Len()) || n != int64(len("It works for download!\n")) {
+		t.Errorf("Expected %d bytes to be written, got %d", buf.Len(), n)
+	}
+}
+
+// TestDownloadFileAt tests downloading a file into a specific offset of a local file.
+func TestDownloadFileAt(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	f, err := os.OpenFile("./tmp/output_at.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0777)
+	if err != nil {
+		t.Errorf("Couldn't open the output file")
+	}
+	defer f.Close()
+
+	f.WriteString("0123456789")
+
+	err = client.CopyFromRemoteAt(context.Background(), f, 5, "/input/another_file.txt")
+	if err != nil {
+		t.Errorf("Copy failed from remote: %s", err.Error())
+	}
+
+	content, err := os.ReadFile("./tmp/output_at.txt")
+	if err != nil {
+		t.Errorf("Result file could not be read: %s", err)
+	}
+
+	text := string(content)
+	expected := "01234Here is some stuff and things.\nEven another line.\n"
+	if strings.Compare(text, expected) != 0 {
+		t.Errorf("Got different text than expected, expected %q got, %q", expected, text)
+	}
+}
+
 func TestDownloadFileInfo(t *testing.T) {
 	client := establishConnection(t)
         defer client.Close()
@@ -277,11 +574,16 @@ func TestDownloadFileInfo(t *testing.T) {
 		t.Errorf("File size does not match")
 	}
 
-	if fs.FileMode(fileInfos.Permissions) != fileStat.Mode() {
+	mode, err := fileInfos.Mode()
+	if err != nil {
+		t.Errorf("Invalid file permissions: %s", err)
+	}
+
+	if mode != fileStat.Mode() {
 		t.Errorf(
 			"File permissions don't match %s vs %s",
-			fs.FileMode(fileInfos.Permissions),
-			fileStat.Mode().Perm(),
+			mode,
+			fileStat.Mode(),
 		)
 	}
 
@@ -294,6 +596,86 @@ func TestDownloadFileInfo(t *testing.T) {
 	}
 }
 
+// TestWalkRemote tests that every entry of a remote directory is reported
+// when walking it.
+func TestWalkRemote(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	entries := map[string]scp.FileInfos{}
+	err := client.WalkRemote(context.Background(), "/input", func(info scp.FileInfos) error {
+		entries[info.Path] = info
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Walking the remote failed: %s", err)
+	}
+
+	if root, ok := entries["/input"]; !ok || !root.IsDir {
+		t.Errorf("Expected /input to be reported as a directory, got %+v", root)
+	}
+
+	file, ok := entries["/input/Exöt1ç download file.txt.txt"]
+	if !ok || file.IsDir {
+		t.Errorf("Expected the download file to be reported as a file, got %+v", file)
+	}
+
+	if file.Size != int64(len("It works for download!\n")) {
+		t.Errorf("File size does not match, got %d", file.Size)
+	}
+}
+
+// TestWalkRemoteFile tests that walking a remote path that is a plain file is rejected.
+func TestWalkRemoteFile(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	err := client.WalkRemote(context.Background(), "/input/another_file.txt", func(info scp.FileInfos) error {
+		return nil
+	})
+	if err != scp.ErrNotDirectory {
+		t.Errorf("Expected %v, got %v", scp.ErrNotDirectory, err)
+	}
+}
+
+// nopWriteCloser turns a writer into an io.WriteCloser that does nothing when closed.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// TestCopyDirFromRemoteFileSink tests that a directory download hands every file
+// to the file sink, and skips the files for which no writer is returned.
+func TestCopyDirFromRemoteFileSink(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	var received []string
+	var buf strings.Builder
+	err := client.CopyDirFromRemote(context.Background(), "/input", "", &scp.DirOptions{
+		FileSink: func(info scp.FileInfos) (io.WriteCloser, error) {
+			received = append(received, info.Filename)
+			if info.Filename != "another_file.txt" {
+				return nil, nil
+			}
+			return nopWriteCloser{&buf}, nil
+		},
+	})
+	if err != nil {
+		t.Errorf("Copy failed from remote: %s", err)
+	}
+
+	if len(received) != 3 {
+		t.Errorf("Expected 3 files to be received, got %v", received)
+	}
+
+	expected := "Here is some stuff and things.\nEven another line.\n"
+	if strings.Compare(buf.String(), expected) != 0 {
+		t.Errorf("Got different text than expected, expected %q got, %q", expected, buf.String())
+	}
+}
+
 // TestTimeoutDownload tests that a timeout error is produced if the file is not copied in the given
 // amount of time.
 func TestTimeoutDownload(t *testing.T) {
@@ -337,6 +719,28 @@ func TestContextCancelDownload(t *testing.T) {
 	}
 }
 
+// blockingReader is a reader that never returns any data.
+type blockingReader struct{}
+
+func (blockingReader) Read(p []byte) (int, error) {
+	select {}
+}
+
+// TestContextDeadlineSlowReader tests that the context is honored while the
+// contents of the reader are being read, before any transfer takes place.
+func TestContextDeadlineSlowReader(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := client.CopyFile(ctx, blockingReader{}, "/data/slow_reader.txt", "0777")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected a timeout error but got %v", err)
+	}
+}
+
 func TestDownloadBadLocalFilePermissions(t *testing.T) {
 	client := establishConnection(t)
 	defer client.Close()
@@ -375,6 +779,48 @@ func TestFileNotFound(t *testing.T) {
 	}
 }
 
+// countingReader is an endless reader that keeps track of how many bytes were read from it.
+type countingReader struct {
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+// TestCopyRejectedByRemote tests that the file contents are not streamed
+// when the remote refuses the file announced in the "C" command.
+func TestCopyRejectedByRemote(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	r := &countingReader{}
+	err := client.Copy(context.Background(), r, "/data/no_such_dir/file.txt", "0777", 1<<40)
+	if err == nil {
+		t.Errorf("Expected error thrown. Got nil")
+	}
+
+	if r.n != 0 {
+		t.Errorf("Expected no bytes to be sent, but %d bytes were read", r.n)
+	}
+}
+
+// TestCopyNShortRead tests that an upload fails instead of hanging when the
+// reader yields fewer bytes than announced.
+func TestCopyNShortRead(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := client.CopyN(ctx, strings.NewReader("It Works\n"), "/data/short_read.txt", "0777", 100)
+	if !errors.Is(err, scp.ErrShortRead) {
+		t.Errorf("Expected %v, got %v", scp.ErrShortRead, err)
+	}
+}
+
 func TestUserSuppliedSSHClientDoesNotClose(t *testing.T) {
 	// create the SSH connection
 	clientConfig, err := buildClientConfig()
@@ -420,6 +866,26 @@ func TestUserSuppliedSSHClientDoesNotClose(t *testing.T) {
 	session.Close()
 }
 
+func TestNewClientBySSHNil(t *testing.T) {
+	_, err := scp.NewClientBySSH(nil)
+	if err != scp.ErrNilSSHClient {
+		t.Errorf("Expected %v, got %v", scp.ErrNilSSHClient, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	config := &ssh.ClientConfig{}
+	client := scp.New("example.com:22", config)
+	if client.Host != "example.com:22" || client.ClientConfig != config || client.RemoteBinary != "scp" {
+		t.Errorf("Unexpected client %+v", client)
+	}
+
+	client, err := scp.NewBySSH(nil)
+	if client != nil || err != scp.ErrNilSSHClient {
+		t.Errorf("Expected %v, got %v", scp.ErrNilSSHClient, err)
+	}
+}
+
 // Ensure that the underlying SSH client managed by the library is correctly closed
 // after closing the SCP connection
 func TestSSHClientNoLeak(t *testing.T) {
@@ -446,3 +912,3001 @@ func TestSSHClientNoLeak(t *testing.T) {
 		t.Fatal("SSH session was not closed.")
 	}
 }
+
+// Ensure that closing the SCP client more than once does not report an error
+// for the already closed SSH connection.
+func TestCloseTwice(t *testing.T) {
+	client := establishConnection(t)
+
+	if err := client.Close(); err != nil {
+		t.Errorf("Could not close the client: %s", err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Errorf("Closing the client a second time failed: %s", err)
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	valid := map[string]fs.FileMode{
+		"0777": 0777,
+		"777":  0777,
+		"0644": 0644,
+		"600":  0600,
+		"4755": fs.ModeSetuid | 0755,
+	}
+	for permissions, expected := range valid {
+		mode, err := scp.ParsePermissions(permissions)
+		if err != nil {
+			t.Errorf("Could not parse %q: %s", permissions, err)
+		}
+		if mode != expected {
+			t.Errorf("Expected %q to parse to %s, got %s", permissions, expected, mode)
+		}
+	}
+
+	for _, permissions := range []string{"", "77", "777x", "999", "07777", "-644"} {
+		if _, err := scp.ParsePermissions(permissions); err == nil {
+			t.Errorf("Expected %q to be rejected", permissions)
+		}
+	}
+}
+
+// TestDownloadTruncated tests that a download fails when the remote closes the
+// stream before sending all the bytes it announced.
+func TestDownloadTruncated(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 100 truncated.txt\n")
+		stdin.Read(ack)
+		stdout.Write([]byte(strings.Repeat("x", 50)))
+		return 1
+	})
+	defer client.Close()
+
+	var buf strings.Builder
+	n, err := client.CopyFromRemoteCount(context.Background(), &buf, "/data/truncated.txt", nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	if n != 50 {
+		t.Errorf("Expected 50 bytes to be written, got %d", n)
+	}
+}
+
+func TestParseResponseTimeWithoutCreate(t *testing.T) {
+	responses := map[string]string{
+		"end of stream": "T1700000000 0 1700000000 0\n",
+		"empty line":    "T1700000000 0 1700000000 0\n\n",
+	}
+
+	for name, response := range responses {
+		_, err := scp.ParseResponse(strings.NewReader(response), io.Discard)
+		if err == nil {
+			t.Errorf("%s: Expected error thrown. Got nil", name)
+		}
+	}
+
+	_, err := scp.ParseResponse(strings.NewReader("T1700000000 0 1700000000 0\n"), io.Discard)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+
+	fileInfos, err := scp.ParseResponse(
+		strings.NewReader("T1700000000 0 1700000001 0\nC0644 5 file.txt\n"),
+		io.Discard,
+	)
+	if err != nil {
+		t.Errorf("Could not parse response: %s", err)
+	}
+	if fileInfos.Size != 5 || fileInfos.Mtime != 1700000000 || fileInfos.Atime != 1700000001 {
+		t.Errorf("Unexpected file infos %+v", fileInfos)
+	}
+}
+
+// TestWithRemoteBinary tests that the remote binary can be overridden for a
+// single call without changing the binary used by the client.
+func TestWithRemoteBinary(t *testing.T) {
+	commands := make(chan string, 2)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		return 1
+	})
+	defer client.Close()
+
+	client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/file.txt", nil, scp.WithRemoteBinary("sudo scp"))
+	if command := <-commands; !strings.HasPrefix(command, "sudo scp ") {
+		t.Errorf("Expected command to use %q, got %q", "sudo scp", command)
+	}
+
+	client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/file.txt", nil)
+	if command := <-commands; !strings.HasPrefix(command, client.RemoteBinary+" ") {
+		t.Errorf("Expected command to use %q, got %q", client.RemoteBinary, command)
+	}
+}
+
+// TestRemoteStderr tests that the standard error of the remote command is part of
+// the error when the remote fails without explaining why through the scp protocol.
+func TestRemoteStderr(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		fmt.Fprint(stderr, "sh: scp: command not found\n")
+		return 127
+	})
+	defer client.Close()
+
+	errs := map[string]error{
+		"download": client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/file.txt", nil),
+		"upload":   client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644"),
+	}
+
+	for name, err := range errs {
+		var remoteErr *scp.RemoteError
+		if !errors.As(err, &remoteErr) {
+			t.Errorf("%s: Expected a RemoteError, got %v", name, err)
+			continue
+		}
+
+		if remoteErr.Stderr != "sh: scp: command not found\n" {
+			t.Errorf("%s: Expected the remote stderr, got %q", name, remoteErr.Stderr)
+		}
+	}
+}
+
+func TestCopyGlobFromRemote(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	localDir := t.TempDir()
+	paths, err := client.CopyGlobFromRemote(context.Background(), "/input/*_file.txt", localDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(paths) != 2 {
+		t.Fatalf("Expected 2 files to be downloaded, got %v", paths)
+	}
+
+	for _, p := range paths {
+		expected, _ := os.ReadFile(filepath.Join("./data", filepath.Base(p)))
+		actual, err := os.ReadFile(p)
+		if err != nil || string(actual) != string(expected) {
+			t.Errorf("Expected %s to match the remote file, got %v", p, err)
+		}
+	}
+}
+
+func TestCopyFileToDir(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	remoteDir := fmt.Sprintf("/data/dir_%d", time.Now().UnixNano())
+	err := client.CopyFileToDir(context.Background(), strings.NewReader("hello"), remoteDir, "file.txt", "0750", "0640")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	dirInfo, err := client.StatRemote(context.Background(), remoteDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !dirInfo.IsDir {
+		t.Errorf("Expected %s to be a directory", remoteDir)
+	}
+
+	var buf strings.Builder
+	err = client.CopyFromRemotePassThru(context.Background(), &buf, remoteDir+"/file.txt", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", buf.String())
+	}
+}
+
+func TestCopyDirToRemote(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	localFiles, _ := os.ReadDir("./data")
+	remoteDir := fmt.Sprintf("/data/tree_%d", time.Now().UnixNano())
+
+	var progress []int
+	err := client.CopyDirToRemote(context.Background(), "./data", remoteDir, &scp.DirOptions{
+		Progress: func(current scp.FileInfos, fileIndex, totalFiles int, bytesInFile int64) {
+			if totalFiles != len(localFiles) {
+				t.Errorf("Expected %d files in total, got %d", len(localFiles), totalFiles)
+			}
+			if bytesInFile == current.Size {
+				progress = append(progress, fileIndex)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(progress) != len(localFiles) {
+		t.Errorf("Expected every file to be reported as complete, got %v", progress)
+	}
+
+	localDir := t.TempDir()
+	err = client.CopyDirFromRemote(context.Background(), remoteDir, localDir, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, file := range localFiles {
+		expected, _ := os.ReadFile(filepath.Join("./data", file.Name()))
+		actual, err := os.ReadFile(filepath.Join(localDir, file.Name()))
+		if err != nil || string(actual) != string(expected) {
+			t.Errorf("Expected %s to round trip, got %v", file.Name(), err)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+	client.DryRun = true
+
+	remotePath := fmt.Sprintf("/data/dry_run_%d.txt", time.Now().UnixNano())
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), remotePath, "0644")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	err = client.CopyFile(context.Background(), strings.NewReader("hello"), "/no_such_dir/file.txt", "0644")
+	if err == nil {
+		t.Errorf("Expected error thrown. Got nil")
+	}
+
+	err = client.CopyFromRemotePassThru(context.Background(), io.Discard, "/input/no_such_file.txt", nil)
+	if err == nil {
+		t.Errorf("Expected error thrown. Got nil")
+	}
+
+	client.DryRun = false
+	if _, err := client.StatRemote(context.Background(), remotePath); err == nil {
+		t.Errorf("Expected %s to not be created by a dry run", remotePath)
+	}
+}
+
+func TestRequireAbsolutePaths(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		t.Errorf("Expected no command to be run, got %q", command)
+		return 1
+	})
+	defer client.Close()
+	client.RequireAbsolutePaths = true
+
+	errs := map[string]error{
+		"upload":   client.CopyFile(context.Background(), strings.NewReader("hello"), "data/file.txt", "0644"),
+		"download": client.CopyFromRemotePassThru(context.Background(), io.Discard, "data/file.txt", nil),
+		"walk":     client.WalkRemote(context.Background(), "data", func(scp.FileInfos) error { return nil }),
+	}
+
+	for name, err := range errs {
+		if !errors.Is(err, scp.ErrRelativePath) {
+			t.Errorf("%s: Expected %v, got %v", name, scp.ErrRelativePath, err)
+		}
+	}
+}
+
+func TestCleanRemotePath(t *testing.T) {
+	paths := map[string]string{
+		"/data/./file.txt":      "/data/file.txt",
+		"/data/dir/../file.txt": "/data/file.txt",
+		"//data//file.txt":      "/data/file.txt",
+		"data/../../file.txt":   "../file.txt",
+		"/../file.txt":          "/file.txt",
+	}
+
+	for remotePath, expected := range paths {
+		if cleaned := scp.CleanRemotePath(remotePath); cleaned != expected {
+			t.Errorf("Expected %q to be cleaned to %q, got %q", remotePath, expected, cleaned)
+		}
+	}
+}
+
+// TestRemoteErrorWinsOverClosedPipe tests that when the remote gives up in the middle of
+// an upload, its reason is returned rather than the error from writing to the closed pipe.
+func TestRemoteErrorWinsOverClosedPipe(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		bufio.NewReader(stdin).ReadString('\n')
+		stdout.Write([]byte{0})
+		fmt.Fprint(stderr, "scp: /data/file.txt: No space left on device\n")
+		return 1
+	})
+	defer client.Close()
+
+	contents := strings.Repeat("x", 4*1024*1024)
+	err := client.CopyFile(context.Background(), strings.NewReader(contents), "/data/file.txt", "0644")
+
+	var remoteErr *scp.RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatalf("Expected a RemoteError, got %v", err)
+	}
+	if !strings.Contains(remoteErr.Stderr, "No space left on device") {
+		t.Errorf("Expected the remote message, got %q", remoteErr.Stderr)
+	}
+}
+
+func TestExpandTilde(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+	client.ExpandTilde = true
+
+	remotePath := fmt.Sprintf("~/tilde_%d.txt", time.Now().UnixNano())
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), remotePath, "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var buf strings.Builder
+	err = client.CopyFromRemotePassThru(context.Background(), &buf, remotePath, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", buf.String())
+	}
+
+	err = client.CopyFile(context.Background(), strings.NewReader("hello"), "~no_such_user/file.txt", "0644")
+	if err == nil {
+		t.Errorf("Expected error thrown. Got nil")
+	}
+}
+
+// doneReader records the calls to Done made once a transfer has ended.
+type doneReader struct {
+	io.Reader
+	errs []error
+}
+
+func (r *doneReader) Done(err error) {
+	r.errs = append(r.errs, err)
+}
+
+func TestPassThruDone(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	var reader *doneReader
+	passThru := func(r io.Reader, total int64) io.Reader {
+		reader = &doneReader{Reader: r}
+		return reader
+	}
+
+	remotePath := fmt.Sprintf("/data/done_%d.txt", time.Now().UnixNano())
+	err := client.CopyFilePassThru(context.Background(), strings.NewReader("hello"), remotePath, "0644", passThru)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(reader.errs) != 1 || reader.errs[0] != nil {
+		t.Errorf("Expected Done to be called once without error, got %v", reader.errs)
+	}
+
+	err = client.CopyFromRemotePassThru(context.Background(), io.Discard, remotePath, passThru)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(reader.errs) != 1 || reader.errs[0] != nil {
+		t.Errorf("Expected Done to be called once without error, got %v", reader.errs)
+	}
+}
+
+func TestPreserveTimesUnsupported(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		bufio.NewReader(stdin).ReadString('\n')
+		fmt.Fprint(stdout, "\x01scp: protocol error: unexpected <T>\n")
+		return 1
+	})
+	defer client.Close()
+
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := client.CopyFile(
+		context.Background(),
+		strings.NewReader("hello"),
+		"/data/file.txt",
+		"0644",
+		scp.WithFileTimes(mtime, mtime),
+	)
+	if !errors.Is(err, scp.ErrPreserveTimesUnsupported) {
+		t.Errorf("Expected %v, got %v", scp.ErrPreserveTimesUnsupported, err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	oldPath := fmt.Sprintf("/data/move_%d.txt", time.Now().UnixNano())
+	newPath := oldPath + ".moved"
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), oldPath, "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := client.Move(context.Background(), oldPath, newPath); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var buf strings.Builder
+	err = client.CopyFromRemotePassThru(context.Background(), &buf, newPath, nil)
+	if err != nil || buf.String() != "hello" {
+		t.Errorf("Expected the file to be moved, got %q, %v", buf.String(), err)
+	}
+
+	err = client.Move(context.Background(), oldPath, newPath)
+	var remoteErr *scp.RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Errorf("Expected a RemoteError, got %v", err)
+	}
+
+	if err := client.Move(context.Background(), "", newPath); err == nil {
+		t.Errorf("Expected error thrown. Got nil")
+	}
+}
+
+func TestFileInfosFromPath(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(localPath, []byte("hello"), 0600); err != nil {
+		t.Fatalf("Couldn't create the local file: %v", err)
+	}
+	if err := os.Chmod(localPath, 0640); err != nil {
+		t.Fatalf("Couldn't change the permissions: %v", err)
+	}
+	mtime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(localPath, mtime, mtime); err != nil {
+		t.Fatalf("Couldn't change the file times: %v", err)
+	}
+
+	fileInfos, err := scp.FileInfosFromPath(localPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := scp.FileInfos{
+		Filename:    "file.txt",
+		Permissions: 0640,
+		Size:        5,
+		Atime:       1700000000,
+		Mtime:       1700000000,
+	}
+	if *fileInfos != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *fileInfos)
+	}
+}
+
+// stutteringReader returns at most one byte per read, and no bytes at all every other read.
+type stutteringReader struct {
+	r     io.Reader
+	empty bool
+}
+
+func (r *stutteringReader) Read(p []byte) (int, error) {
+	r.empty = !r.empty
+	if r.empty || len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
+
+func TestParseResponsePartialReads(t *testing.T) {
+	responses := []string{
+		"C0644 5 file.txt\n",
+		"T1700000000 0 1700000001 0\nC0644 5 file.txt\n",
+	}
+
+	for _, response := range responses {
+		reader := &stutteringReader{r: strings.NewReader(response)}
+		fileInfos, err := scp.ParseResponse(reader, io.Discard)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", response, err)
+			continue
+		}
+
+		if fileInfos.Filename != "file.txt" || fileInfos.Size != 5 || fileInfos.Permissions != 0644 {
+			t.Errorf("Unexpected file infos for %q: %+v", response, fileInfos)
+		}
+	}
+
+	reader := &stutteringReader{r: strings.NewReader("\x02scp: file.txt: Permission denied\n")}
+	_, err := scp.ParseResponse(reader, io.Discard)
+	if err == nil || err.Error() != "scp: file.txt: Permission denied\n" {
+		t.Errorf("Expected the remote error, got %v", err)
+	}
+}
+
+func TestSFTPFallback(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+	client.SFTPFallback = true
+
+	// Pretend the remote has no scp binary
+	missingBinary := scp.WithRemoteBinary("/no_such_dir/scp")
+
+	remotePath := fmt.Sprintf("/data/sftp_%d.txt", time.Now().UnixNano())
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), remotePath, "0640", missingBinary)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var buf strings.Builder
+	fileInfos, err := client.CopyFromRemoteFileInfos(context.Background(), &buf, remotePath, nil, missingBinary)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", buf.String())
+	}
+	if fileInfos.Size != 5 || fileInfos.Permissions != 0640 {
+		t.Errorf("Unexpected file infos: %+v", fileInfos)
+	}
+
+	client.SFTPFallback = false
+	err = client.CopyFile(context.Background(), strings.NewReader("hello"), remotePath, "0640", missingBinary)
+	var remoteErr *scp.RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Errorf("Expected a RemoteError without the fallback, got %v", err)
+	}
+}
+
+func TestContextDeadlineOverridesTimeout(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(stdout, "C0644 5 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello\x00")
+		stdin.Read(ack)
+		return 0
+	})
+	defer client.Close()
+	client.Timeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var buf strings.Builder
+	err := client.CopyFromRemotePassThru(ctx, &buf, "/data/file.txt", nil)
+	if err != nil {
+		t.Errorf("Expected the deadline of the context to be used, got %v", err)
+	}
+
+	err = client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/file.txt", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestFileInfosMode(t *testing.T) {
+	fileInfos := scp.FileInfos{Permissions: 04755}
+	mode, err := fileInfos.Mode()
+	if err != nil || mode != os.ModeSetuid|0755 {
+		t.Errorf("Expected %v, got %v, %v", os.ModeSetuid|0755, mode, err)
+	}
+
+	fileInfos = scp.FileInfos{Permissions: 0750, IsDir: true}
+	mode, err = fileInfos.Mode()
+	if err != nil || mode != os.ModeDir|0750 {
+		t.Errorf("Expected %v, got %v, %v", os.ModeDir|0750, mode, err)
+	}
+
+	fileInfos = scp.FileInfos{Permissions: 010644}
+	if _, err := fileInfos.Mode(); err == nil {
+		t.Errorf("Expected error thrown. Got nil")
+	}
+}
+
+func TestSshAgentNotAvailable(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	_, err := auth.SshAgentContext(context.Background(), "bram", ssh.InsecureIgnoreHostKey())
+	if !errors.Is(err, auth.ErrNoAgent) {
+		t.Errorf("Expected %v, got %v", auth.ErrNoAgent, err)
+	}
+}
+
+func TestSshAgentWithCloser(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Couldn't listen on the agent socket: %v", err)
+	}
+	defer listener.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		served <- agent.ServeAgent(agent.NewKeyring(), conn)
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", socket)
+	_, closer, err := auth.SshAgentWithCloser(context.Background(), "bram", ssh.InsecureIgnoreHostKey())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := closer.Close(); err != nil {
+		t.Errorf("Unexpected error closing the agent connection: %v", err)
+	}
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the agent connection to be closed")
+	}
+}
+
+func TestPrivateKeyBytes(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate a key: %v", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("Couldn't encode the key: %v", err)
+	}
+	config, err := auth.PrivateKeyBytes("bram", pem.EncodeToMemory(block), ssh.InsecureIgnoreHostKey())
+	if err != nil || len(config.Auth) != 1 {
+		t.Errorf("Expected a config with a single auth method, got %v", err)
+	}
+
+	block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Couldn't encode the key: %v", err)
+	}
+	_, err = auth.PrivateKeyWithPassphraseBytes("bram", []byte("passphrase"), pem.EncodeToMemory(block), ssh.InsecureIgnoreHostKey())
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	_, err = auth.PrivateKeyWithPassphraseBytes("bram", []byte("wrong"), pem.EncodeToMemory(block), ssh.InsecureIgnoreHostKey())
+	if err == nil {
+		t.Errorf("Expected error thrown. Got nil")
+	}
+}
+
+func TestPrivateKeys(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"id_a", "id_b"} {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Couldn't generate a key: %v", err)
+		}
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatalf("Couldn't encode the key: %v", err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	invalid := filepath.Join(dir, "invalid")
+	os.WriteFile(invalid, []byte("not a key"), 0600)
+
+	config, warnings, err := auth.PrivateKeysWithWarnings("bram", append(paths, invalid, filepath.Join(dir, "missing")), ssh.InsecureIgnoreHostKey())
+	if err != nil || len(config.Auth) != 1 {
+		t.Errorf("Expected a config with a single auth method, got %v", err)
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0].Error(), "invalid") || !errors.Is(warnings[1], fs.ErrNotExist) {
+		t.Errorf("Expected the invalid and missing keys to be skipped, got %v", warnings)
+	}
+
+	_, err = auth.PrivateKeys("bram", []string{invalid}, ssh.InsecureIgnoreHostKey())
+	if !errors.Is(err, auth.ErrNoPrivateKey) {
+		t.Errorf("Expected %v, got %v", auth.ErrNoPrivateKey, err)
+	}
+}
+
+// BenchmarkBufferSize measures downloads of a large file from the fake remote
+// with different buffer sizes.
+func BenchmarkBufferSize(b *testing.B) {
+	const size = 16 << 20
+	contents := bytes.Repeat([]byte("x"), size)
+
+	client := connectFakeRemote(b, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprintf(stdout, "C0644 %d large.bin\n", size)
+		stdin.Read(ack)
+		stdout.Write(contents)
+		stdout.Write([]byte{0})
+		stdin.Read(ack)
+		return 0
+	})
+	defer client.Close()
+
+	for _, bufferSize := range []int{0, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", bufferSize>>10), func(b *testing.B) {
+			client.BufferSize = bufferSize
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				err := client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/large.bin", nil)
+				if err != nil {
+					b.Fatalf("Download failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestParseErrorNamesFile tests that a malformed record is reported with the remote path
+// of the file it was sent for.
+func TestParseErrorNamesFile(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		if strings.Contains(command, " -prf ") {
+			fmt.Fprint(stdout, "D0755 0 data\n")
+			stdin.Read(ack)
+		}
+		fmt.Fprint(stdout, "C0644 large foo.bin\n")
+		stdin.Read(ack)
+		return 1
+	})
+	defer client.Close()
+
+	err := client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/foo.bin", nil)
+	expected := `file "/data/foo.bin": unable to parse size field`
+	if err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("Expected error starting with %q, got %v", expected, err)
+	}
+
+	err = client.WalkRemote(context.Background(), "/data", func(scp.FileInfos) error { return nil })
+	if err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("Expected error starting with %q, got %v", expected, err)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 large foo.bin\n")
+		stdin.Read(ack)
+		return 1
+	})
+	defer client.Close()
+
+	err := client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/foo.bin", nil)
+	var protocolErr *scp.ProtocolError
+	if !errors.As(err, &protocolErr) {
+		t.Fatalf("Expected a ProtocolError, got %v", err)
+	}
+	if protocolErr.Line != "C0644 large foo.bin\n" || protocolErr.Offset != 6 {
+		t.Errorf("Expected the size field of the raw line, got offset %d of %q", protocolErr.Offset, protocolErr.Line)
+	}
+	if !strings.Contains(err.Error(), `"C0644 large foo.bin\n"`) {
+		t.Errorf("Expected the raw line in the error, got %v", err)
+	}
+}
+
+func TestCopyStream(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	contents := strings.Repeat("streamed line\n", 10000)
+	r, w := io.Pipe()
+	go func() {
+		for _, line := range strings.SplitAfter(contents, "\n") {
+			io.WriteString(w, line)
+		}
+		w.Close()
+	}()
+
+	remotePath := fmt.Sprintf("/tmp/stream_%d.txt", time.Now().UnixNano())
+	err := client.CopyStream(context.Background(), r, remotePath, "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var buf strings.Builder
+	err = client.CopyFromRemotePassThru(context.Background(), &buf, remotePath, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != contents {
+		t.Errorf("Expected %d bytes to be copied, got %d", len(contents), buf.Len())
+	}
+}
+
+// TestEvents tests that the lifecycle of transfers is reported on the events channel,
+// and that it is closed by Close.
+func TestEvents(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		record, _ := reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		if strings.Contains(record, "fail") {
+			stdout.Write([]byte("\x02scp: no space left\n"))
+			return 1
+		}
+		stdout.Write([]byte{0})
+		return 0
+	})
+	events := client.Events()
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/ok.txt", "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	err = client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/fail.txt", "0644")
+	if err == nil {
+		t.Fatalf("Expected error thrown. Got nil")
+	}
+	client.Close()
+
+	var received []scp.TransferEvent
+	for event := range events {
+		if _, ok := event.(scp.Progress); !ok {
+			received = append(received, event)
+		}
+	}
+
+	if len(received) != 4 {
+		t.Fatalf("Expected 4 events, got %#v", received)
+	}
+	if started, ok := received[0].(scp.TransferStarted); !ok || started.Path != "/data/ok.txt" || started.Size != 5 {
+		t.Errorf("Expected the transfer of /data/ok.txt to start, got %#v", received[0])
+	}
+	if completed, ok := received[1].(scp.TransferCompleted); !ok || completed.Bytes != 5 {
+		t.Errorf("Expected the transfer of /data/ok.txt to complete, got %#v", received[1])
+	}
+	if failed, ok := received[3].(scp.TransferFailed); !ok || failed.Path != "/data/fail.txt" || failed.Err == nil {
+		t.Errorf("Expected the transfer of /data/fail.txt to fail, got %#v", received[3])
+	}
+}
+
+// TestEventsConcurrent tests that concurrent calls to Events all return the same channel while
+// a transfer emits events.
+func TestEventsConcurrent(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+
+	var wg sync.WaitGroup
+	channels := make([]<-chan scp.TransferEvent, 8)
+	for i := range channels {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			channels[i] = client.Events()
+		}(i)
+	}
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	wg.Wait()
+	client.Close()
+
+	for _, ch := range channels {
+		if ch != channels[0] {
+			t.Fatalf("Expected every call to return the same channel")
+		}
+	}
+	for range channels[0] {
+	}
+}
+func TestWithFilename(t *testing.T) {
+	records := make(chan string, 2)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		record, _ := reader.ReadString('\n')
+		records <- command + "|" + record
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/", "0644", scp.WithFilename("renamed.txt"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := client.RemoteBinary + " -qt '/data'|C0644 5 renamed.txt\n"
+	if received := <-records; received != expected {
+		t.Errorf("Expected %q, got %q", expected, received)
+	}
+
+	// The remote path is still passed to the remote scp when it is not a directory
+	err = client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644", scp.WithFilename("renamed.txt"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = client.RemoteBinary + " -qt '/data/file.txt'|C0644 5 renamed.txt\n"
+	if received := <-records; received != expected {
+		t.Errorf("Expected %q, got %q", expected, received)
+	}
+
+	for remotePath, filename := range map[string]string{
+		"/data/":         "../escape.txt",
+		"/data/file.txt": "dir/renamed.txt",
+		"/data/dir/":     "file.txt\nC0644 5 injected.txt",
+	} {
+		err = client.CopyFile(context.Background(), strings.NewReader("hello"), remotePath, "0644", scp.WithFilename(filename))
+		if !errors.Is(err, scp.ErrInvalidFilename) {
+			t.Errorf("Expected ErrInvalidFilename for %q in %q, got %v", filename, remotePath, err)
+		}
+	}
+
+	files := []scp.NamedReader{{Name: "file.txt\nC0644 5 injected.txt", Reader: strings.NewReader("hello"), Size: 5, Permissions: "0644"}}
+	if err := client.CopyFilesToDir(context.Background(), "/data", files); !errors.Is(err, scp.ErrInvalidFilename) {
+		t.Errorf("Expected ErrInvalidFilename for a name with a newline, got %v", err)
+	}
+	err = client.CopyFileToDir(context.Background(), strings.NewReader("hello"), "/data/dir", "file.txt\n", "0755", "0644")
+	if !errors.Is(err, scp.ErrInvalidFilename) {
+		t.Errorf("Expected ErrInvalidFilename for a name with a newline, got %v", err)
+	}
+}
+
+// TestUploadTarget tests that an upload to a remote path ending in "/" stores the file in that
+// directory, and that any other remote path is split into its parent directory and base name.
+// Without a file name, a directory stores the file under its own base name.
+func TestUploadTarget(t *testing.T) {
+	records := make(chan string, 2)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		record, _ := reader.ReadString('\n')
+		records <- command + "|" + record
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := client.RemoteBinary + " -qt '/data'|C0644 5 file.txt\n"
+	if received := <-records; received != expected {
+		t.Errorf("Expected %q, got %q", expected, received)
+	}
+
+	err = client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/dir/", "0644", scp.WithFilename("file.txt"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = client.RemoteBinary + " -qt '/data/dir'|C0644 5 file.txt\n"
+	if received := <-records; received != expected {
+		t.Errorf("Expected %q, got %q", expected, received)
+	}
+
+	// Without a file name, the file is stored under the base name of the directory
+	err = client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/dir/", "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected = client.RemoteBinary + " -qt '/data/dir'|C0644 5 dir\n"
+	if received := <-records; received != expected {
+		t.Errorf("Expected %q, got %q", expected, received)
+	}
+
+	err = client.CopyFile(context.Background(), strings.NewReader("hello"), "/", "0644")
+	if !errors.Is(err, scp.ErrInvalidFilename) {
+		t.Errorf("Expected ErrInvalidFilename for the root directory without a file name, got %v", err)
+	}
+}
+
+// TestDownloadReadOnlyFile tests that a download into a file that can not be written
+// fails before the remote starts sending the contents.
+func TestDownloadReadOnlyFile(t *testing.T) {
+	responses := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 5 file.txt\n")
+		response, _ := bufio.NewReader(stdin).ReadString('\n')
+		responses <- response
+		return 1
+	})
+	defer client.Close()
+
+	localPath := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(localPath, nil, 0644); err != nil {
+		t.Fatalf("Couldn't create the local file: %v", err)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		t.Fatalf("Couldn't open the local file: %v", err)
+	}
+	defer f.Close()
+
+	err = client.CopyFromRemote(context.Background(), f, "/data/file.txt")
+	if err == nil || !strings.Contains(err.Error(), "not writable") {
+		t.Errorf("Expected the local file not to be writable, got %v", err)
+	}
+	if response := <-responses; !strings.HasPrefix(response, "\x02") {
+		t.Errorf("Expected the transfer to be aborted, got %q", response)
+	}
+}
+
+func TestSyncToRemote(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	localDir := t.TempDir()
+	os.WriteFile(filepath.Join(localDir, "kept.txt"), []byte("kept"), 0644)
+	os.WriteFile(filepath.Join(localDir, "changed.txt"), []byte("before"), 0644)
+	remoteDir := fmt.Sprintf("/data/sync_%d", time.Now().UnixNano())
+
+	report, err := client.SyncToRemote(context.Background(), localDir, remoteDir, scp.SyncOptions{})
+	if err != nil || report.Uploaded != 2 {
+		t.Fatalf("Expected 2 files to be uploaded, got %+v: %v", report, err)
+	}
+
+	os.WriteFile(filepath.Join(localDir, "changed.txt"), []byte("after the change"), 0644)
+	os.Remove(filepath.Join(localDir, "kept.txt"))
+
+	report, err = client.SyncToRemote(context.Background(), localDir, remoteDir, scp.SyncOptions{Delete: true, DryRun: true})
+	expected := scp.SyncReport{Uploaded: 1, Deleted: 1}
+	if err != nil || report != expected {
+		t.Errorf("Expected %+v for a dry run, got %+v: %v", expected, report, err)
+	}
+
+	report, err = client.SyncToRemote(context.Background(), localDir, remoteDir, scp.SyncOptions{Delete: true})
+	if err != nil || report != expected {
+		t.Errorf("Expected %+v, got %+v: %v", expected, report, err)
+	}
+
+	report, err = client.SyncToRemote(context.Background(), localDir, remoteDir, scp.SyncOptions{Delete: true})
+	expected = scp.SyncReport{Skipped: 1}
+	if err != nil || report != expected {
+		t.Errorf("Expected %+v once in sync, got %+v: %v", expected, report, err)
+	}
+}
+
+func TestAppendToRemote(t *testing.T) {
+	client := establishConnection(t)
+	defer client.Close()
+
+	remotePath := fmt.Sprintf("/tmp/append_%d.txt", time.Now().UnixNano())
+	err := client.CopyFile(context.Background(), strings.NewReader("hello "), remotePath, "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	r := strings.NewReader("hello world")
+	r.Seek(6, io.SeekStart)
+	err = client.AppendToRemote(context.Background(), r, remotePath, 5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var buf strings.Builder
+	err = client.CopyFromRemotePassThru(context.Background(), &buf, remotePath, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != "hello world" {
+		t.Errorf("Expected %q, got %q", "hello world", buf.String())
+	}
+
+	// The remote file already holds the whole contents
+	r.Seek(6, io.SeekStart)
+	err = client.AppendToRemote(context.Background(), r, remotePath, 5)
+	if !errors.Is(err, scp.ErrUnexpectedRemoteSize) {
+		t.Errorf("Expected %v, got %v", scp.ErrUnexpectedRemoteSize, err)
+	}
+}
+
+func TestParseResponseDirectory(t *testing.T) {
+	responses := map[string]string{
+		"directory":           "D0755 0 logs\n",
+		"directory with time": "T1700000000 0 1700000001 0\nD0755 0 logs\n",
+	}
+
+	for name, response := range responses {
+		fileInfos, err := scp.ParseResponse(strings.NewReader(response), io.Discard)
+		if err != nil {
+			t.Errorf("%s: Could not parse response: %s", name, err)
+			continue
+		}
+		if !fileInfos.IsDir || fileInfos.Filename != "logs" || fileInfos.Permissions != 0755 || fileInfos.Size != 0 {
+			t.Errorf("%s: Unexpected file infos %+v", name, fileInfos)
+		}
+	}
+
+	fileInfos, err := scp.ParseResponse(strings.NewReader("C0644 5 logs\n"), io.Discard)
+	if err != nil || fileInfos.IsDir {
+		t.Errorf("Expected a file, got %+v: %v", fileInfos, err)
+	}
+}
+
+func TestParseResponseCRLF(t *testing.T) {
+	fileInfos, err := scp.ParseResponse(strings.NewReader("T1700000000 0 1700000001 0\r\nC0644 42 test\r\n"), io.Discard)
+	if err != nil {
+		t.Fatalf("Could not parse response: %s", err)
+	}
+	if fileInfos.Filename != "test" || fileInfos.Size != 42 || fileInfos.Atime != 1700000001 {
+		t.Errorf("Unexpected file infos %+v", fileInfos)
+	}
+}
+
+func TestParseResponseEndDirectory(t *testing.T) {
+	_, err := scp.ParseResponse(strings.NewReader("E\n"), io.Discard)
+	if !errors.Is(err, scp.ErrEndDirectory) {
+		t.Errorf("Expected %v, got %v", scp.ErrEndDirectory, err)
+	}
+
+	// Reading through a single bufio.Reader keeps the records that follow
+	reader := bufio.NewReader(strings.NewReader("D0755 0 logs\nE\nD0700 0 cache\n"))
+	expected := []error{nil, scp.ErrEndDirectory, nil}
+	for i, expectedErr := range expected {
+		_, err := scp.ParseResponse(reader, io.Discard)
+		if err != expectedErr {
+			t.Errorf("Record %d: Expected %v, got %v", i, expectedErr, err)
+		}
+	}
+}
+
+// slowReader yields a byte at a time with a delay, counting the reads made.
+type slowReader struct {
+	reads atomic.Int64
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	r.reads.Add(1)
+	time.Sleep(time.Millisecond)
+	p[0] = 'x'
+	return 1, nil
+}
+
+// TestUploadStopsWhenRemoteExits tests that an upload stops reading its input as soon as
+// the remote exits, and that the reason of the remote is returned.
+func TestUploadStopsWhenRemoteExits(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 10)
+		fmt.Fprint(stderr, "scp: /data/file.txt: No space left on device\n")
+		return 1
+	})
+	defer client.Close()
+
+	r := &slowReader{}
+	err := client.CopyN(context.Background(), r, "/data/file.txt", "0644", 1<<30)
+
+	var remoteErr *scp.RemoteError
+	if !errors.As(err, &remoteErr) || !strings.Contains(remoteErr.Stderr, "No space left on device") {
+		t.Fatalf("Expected the remote error, got %v", err)
+	}
+
+	reads := r.reads.Load()
+	time.Sleep(50 * time.Millisecond)
+	if r.reads.Load() != reads {
+		t.Errorf("Expected the input not to be read once the upload returned")
+	}
+}
+
+// TestLegacyAlgorithms tests that the legacy preset can still negotiate with a server
+// that only supports legacy algorithms.
+func TestLegacyAlgorithms(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.Ciphers = []string{"aes128-cbc"}
+	serverConfig.KeyExchanges = []string{"diffie-hellman-group1-sha1"}
+	serverConfig.MACs = []string{"hmac-sha1"}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen for connections: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ssh.NewServerConn(conn, serverConfig)
+		}
+	}()
+
+	config := ssh.ClientConfig{User: "bram", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	if _, err := ssh.Dial("tcp", listener.Addr().String(), &config); err == nil {
+		t.Errorf("Expected the default algorithms to be rejected")
+	}
+
+	config = auth.WithLegacyAlgorithms(config)
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client.Close()
+
+	config = auth.WithAlgorithms(config, []string{"aes256-ctr"}, nil, nil)
+	if len(config.Ciphers) != 1 || len(config.MACs) != len(auth.LegacyMACs) {
+		t.Errorf("Expected only the ciphers to be replaced, got %+v", config.Config)
+	}
+}
+
+func TestPermissionMask(t *testing.T) {
+	records := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		record, _ := reader.ReadString('\n')
+		records <- record
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+	client.PermissionMask = 0755
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0777")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if record := <-records; record != "C0755 5 file.txt\n" {
+		t.Errorf("Expected the permissions to be masked, got %q", record)
+	}
+}
+
+// TestPermissionWidth tests that the permissions in the records sent to the remote always
+// have four octal digits, like OpenSSH sends them.
+func TestPermissionWidth(t *testing.T) {
+	records := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		record, _ := reader.ReadString('\n')
+		records <- record
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+
+	for permissions, expected := range map[string]string{
+		"000":  "C0000 5 file.txt\n",
+		"0644": "C0644 5 file.txt\n",
+		"755":  "C0755 5 file.txt\n",
+		"0777": "C0777 5 file.txt\n",
+		"4755": "C4755 5 file.txt\n",
+	} {
+		err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", permissions)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if record := <-records; record != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, permissions, record)
+		}
+	}
+}
+
+func TestRemoteSCPVersion(t *testing.T) {
+	commands := make(chan string, 8)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		fmt.Fprint(stdout, "OpenSSH_9.6p1 Ubuntu-3ubuntu13, OpenSSL 3.0.13 30 Jan 2024\n")
+		return 0
+	})
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		version, err := client.RemoteSCPVersion(context.Background())
+		if err != nil || version != "9.6p1" {
+			t.Errorf("Expected version %q, got %q: %v", "9.6p1", version, err)
+		}
+	}
+	if len(commands) != 1 {
+		t.Errorf("Expected the version to be cached, the remote was asked %d times", len(commands))
+	}
+
+	// Connecting again may reach another host, concurrent calls ask it again
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.RemoteSCPVersion(context.Background()); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(commands) < 2 {
+		t.Errorf("Expected the version to be asked again after connecting again")
+	}
+
+	other := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		fmt.Fprint(stdout, "Dropbear v2022.83\n")
+		return 0
+	})
+	defer other.Close()
+	if _, err := other.RemoteSCPVersion(context.Background()); !errors.Is(err, scp.ErrUnknownVersion) {
+		t.Errorf("Expected %v, got %v", scp.ErrUnknownVersion, err)
+	}
+}
+
+func TestOpenRemote(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0640 11 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello world\x00")
+		stdin.Read(ack)
+		return 0
+	})
+	defer client.Close()
+
+	r, info, err := client.OpenRemote(context.Background(), "/data/file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Size != 11 || info.Permissions != 0640 {
+		t.Errorf("Unexpected file infos %+v", info)
+	}
+
+	contents, err := io.ReadAll(r)
+	if err != nil || string(contents) != "hello world" {
+		t.Errorf("Expected %q, got %q: %v", "hello world", contents, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Closing before the contents were read aborts the transfer
+	r, _, err = client.OpenRemote(context.Background(), "/data/file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	io.CopyN(io.Discard, r, 5)
+	if err := r.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Expected closing twice to be safe, got %v", err)
+	}
+}
+
+// TestOpenRemoteHoldsSession tests that with the default session limit, a transfer started
+// while a reader of OpenRemote is open waits for its session, until the context is done.
+func TestOpenRemoteHoldsSession(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0640 11 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello world\x00")
+		stdin.Read(ack)
+		return 0
+	})
+	defer client.Close()
+
+	r, _, err := client.OpenRemote(context.Background(), "/data/file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.StatRemote(ctx, "/data/file.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v while the reader is open, got %v", context.DeadlineExceeded, err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := client.StatRemote(context.Background(), "/data/file.txt"); err != nil {
+		t.Errorf("Expected the session to be available once the reader is closed, got %v", err)
+	}
+}
+
+func TestCopyRangeFromRemote(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0640 11 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello world\x00")
+		stdin.Read(ack)
+		return 0
+	})
+	defer client.Close()
+
+	for _, test := range []struct {
+		offset, length int64
+		expected       string
+	}{
+		{0, 5, "hello"},
+		{6, 5, "world"},
+		{6, 100, "world"},
+		{20, 5, ""},
+	} {
+		var buf bytes.Buffer
+		n, err := client.CopyRangeFromRemote(context.Background(), &buf, "/data/file.txt", test.offset, test.length)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if buf.String() != test.expected || n != int64(len(test.expected)) {
+			t.Errorf("Expected %q at offset %d, got %d bytes %q", test.expected, test.offset, n, buf.String())
+		}
+	}
+
+	if _, err := client.CopyRangeFromRemote(context.Background(), io.Discard, "/data/file.txt", -1, 5); err == nil {
+		t.Errorf("Expected error thrown for a negative offset. Got nil")
+	}
+}
+
+func TestRefuseSymlinks(t *testing.T) {
+	commands := make(chan string, 2)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		if strings.Contains(command, "test -L") {
+			fmt.Fprint(stdout, "/data/passwd\n")
+		}
+		return 0
+	})
+	defer client.Close()
+	client.RefuseSymlinks = true
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/passwd", "0644")
+	if !errors.Is(err, scp.ErrRemoteSymlink) {
+		t.Errorf("Expected %v, got %v", scp.ErrRemoteSymlink, err)
+	}
+	if len(commands) != 1 {
+		t.Errorf("Expected only the check to run on the remote, got %d commands", len(commands))
+	}
+}
+
+// TestCancelSingleTransfer tests that cancelling the context of a transfer only stops
+// that transfer, while another transfer over the same connection carries on.
+func TestCancelSingleTransfer(t *testing.T) {
+	started := make(chan string, 2)
+	slowStopped := make(chan struct{})
+	release := make(chan struct{})
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		if strings.Contains(command, "slow") {
+			fmt.Fprint(stdout, "C0644 1000 slow.txt\n")
+			stdin.Read(ack)
+			stdout.Write([]byte("x"))
+			started <- "slow"
+			// Only returns once the client closed the session
+			io.Copy(io.Discard, stdin)
+			close(slowStopped)
+			return 1
+		}
+		fmt.Fprint(stdout, "C0644 5 fast.txt\n")
+		stdin.Read(ack)
+		started <- "fast"
+		<-release
+		fmt.Fprint(stdout, "hello\x00")
+		stdin.Read(ack)
+		return 0
+	})
+	defer client.Close()
+	client.MaxConcurrentSessions = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slowErr := make(chan error, 1)
+	go func() {
+		slowErr <- client.CopyFromRemotePassThru(ctx, io.Discard, "/data/slow.txt", nil)
+	}()
+
+	var buf strings.Builder
+	fastErr := make(chan error, 1)
+	go func() {
+		fastErr <- client.CopyFromRemotePassThru(context.Background(), &buf, "/data/fast.txt", nil)
+	}()
+	<-started
+	<-started
+
+	cancel()
+	if err := <-slowErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	select {
+	case <-slowStopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the session of the cancelled transfer to be closed")
+	}
+
+	close(release)
+	if err := <-fastErr; err != nil || buf.String() != "hello" {
+		t.Errorf("Expected the other transfer to succeed, got %q: %v", buf.String(), err)
+	}
+}
+
+func TestCopyFileWithOwner(t *testing.T) {
+	commands := make(chan string, 3)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		if strings.HasPrefix(command, "sudo chown") {
+			fmt.Fprint(stderr, "chown: invalid user: 'www'\n")
+			return 1
+		}
+		if !strings.Contains(command, "scp -qt") {
+			return 0
+		}
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+	client.RemoteBinary = "sudo scp"
+
+	err := client.CopyFileWithOwner(context.Background(), strings.NewReader("hello"), "/srv/app.conf", "0644", "www", "www")
+	var remoteErr *scp.RemoteError
+	if !errors.As(err, &remoteErr) {
+		t.Fatalf("Expected the failing chown to be returned, got %v", err)
+	}
+
+	<-commands
+	if command := <-commands; command != "sudo chown -- 'www:www' '/srv/app.conf'" {
+		t.Errorf("Unexpected chown command %q", command)
+	}
+	if command := <-commands; command != "sudo rm -f -- '/srv/app.conf'" {
+		t.Errorf("Expected the uploaded file to be removed, got %q", command)
+	}
+}
+
+func TestPing(t *testing.T) {
+	commands := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		return 0
+	})
+
+	if err := client.Ping(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(commands) != 0 {
+		t.Errorf("Expected no command to be run on the remote, got %q", <-commands)
+	}
+
+	client.Close()
+	if err := client.Ping(context.Background()); !errors.Is(err, scp.ErrNotConnected) {
+		t.Errorf("Expected %v after the connection was closed, got %v", scp.ErrNotConnected, err)
+	}
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if !errors.Is(err, scp.ErrNotConnected) {
+		t.Errorf("Expected %v from an upload after the connection was closed, got %v", scp.ErrNotConnected, err)
+	}
+}
+
+// TestNotConnected tests that using a client that was never connected returns an error
+// instead of panicking.
+func TestNotConnected(t *testing.T) {
+	clients := map[string]scp.Client{
+		"zero value":    {},
+		"not connected": scp.NewClientWithTimeout("127.0.0.1:22", &ssh.ClientConfig{}, time.Second),
+	}
+
+	for name, client := range clients {
+		errs := map[string]error{
+			"upload":   client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644"),
+			"download": client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/file.txt", nil),
+			"walk":     client.WalkRemote(context.Background(), "/data", func(scp.FileInfos) error { return nil }),
+			"chmod":    client.Chmod(context.Background(), "/data/file.txt", 0644),
+			"ping":     client.Ping(context.Background()),
+		}
+		_, _, errs["open"] = client.OpenRemote(context.Background(), "/data/file.txt")
+
+		for method, err := range errs {
+			if !errors.Is(err, scp.ErrNotConnected) {
+				t.Errorf("%s: Expected %v from %s, got %v", name, scp.ErrNotConnected, method, err)
+			}
+		}
+	}
+}
+
+func TestEnvRejected(t *testing.T) {
+	commands := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		return 0
+	})
+	defer client.Close()
+	client.Env = map[string]string{"SCP_TENANT": "acme"}
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if err == nil || !strings.Contains(err.Error(), "SCP_TENANT") {
+		t.Errorf("Expected the rejected variable to be reported, got %v", err)
+	}
+	if len(commands) != 0 {
+		t.Errorf("Expected scp not to be run, got %q", <-commands)
+	}
+}
+
+func TestResponseTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		<-hang
+		return 0
+	})
+	defer client.Close()
+	client.ResponseTimeout = 100 * time.Millisecond
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if !errors.Is(err, scp.ErrResponseTimeout) {
+		t.Errorf("Expected %v for the upload, got %v", scp.ErrResponseTimeout, err)
+	}
+
+	err = client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/file.txt", nil)
+	if !errors.Is(err, scp.ErrResponseTimeout) {
+		t.Errorf("Expected %v for the download, got %v", scp.ErrResponseTimeout, err)
+	}
+
+	_, _, err = client.OpenRemote(context.Background(), "/data/file.txt")
+	if !errors.Is(err, scp.ErrResponseTimeout) {
+		t.Errorf("Expected %v for opening, got %v", scp.ErrResponseTimeout, err)
+	}
+}
+
+func TestCopyFromRemoteHashed(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 11 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello world\x00")
+		stdin.Read(ack)
+		return 0
+	})
+	defer client.Close()
+
+	var buf bytes.Buffer
+	h := sha256.New()
+	info, err := client.CopyFromRemoteHashed(context.Background(), &buf, "/data/file.txt", h)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Size != 11 || buf.String() != "hello world" {
+		t.Errorf("Unexpected download %q with file infos %+v", buf.String(), info)
+	}
+	if expected := sha256.Sum256([]byte("hello world")); !bytes.Equal(h.Sum(nil), expected[:]) {
+		t.Errorf("Expected digest %x, got %x", expected, h.Sum(nil))
+	}
+}
+
+func TestCopyTar(t *testing.T) {
+	commands := make(chan string, 2)
+	received := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		if strings.Contains(command, "tar -x") {
+			contents, _ := io.ReadAll(stdin)
+			received <- string(contents)
+			return 0
+		}
+		fmt.Fprint(stdout, "tar stream")
+		return 0
+	})
+	defer client.Close()
+
+	err := client.CopyTarToRemote(context.Background(), strings.NewReader("tar stream"), "/srv/app")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if command := <-commands; command != "tar -x -C '/srv/app'" {
+		t.Errorf("Unexpected command %q", command)
+	}
+	if contents := <-received; contents != "tar stream" {
+		t.Errorf("Expected the stream to be piped into tar, got %q", contents)
+	}
+
+	var buf bytes.Buffer
+	if err := client.CopyTarFromRemote(context.Background(), &buf, "/srv/app"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if command := <-commands; command != "tar -c -C '/srv/app' ." {
+		t.Errorf("Unexpected command %q", command)
+	}
+	if buf.String() != "tar stream" {
+		t.Errorf("Expected the stream of tar, got %q", buf.String())
+	}
+}
+
+func TestConnectionClosed(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		// Accept the session, but drop it before scp says anything
+		return -1
+	})
+	defer client.Close()
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if !errors.Is(err, scp.ErrConnectionClosed) {
+		t.Errorf("Expected %v for the upload, got %v", scp.ErrConnectionClosed, err)
+	}
+
+	err = client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/file.txt", nil)
+	if !errors.Is(err, scp.ErrConnectionClosed) {
+		t.Errorf("Expected %v for the download, got %v", scp.ErrConnectionClosed, err)
+	}
+
+	failing := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		fmt.Fprint(stderr, "sh: scp: not found\n")
+		return 127
+	})
+	defer failing.Close()
+
+	err = failing.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	var remoteErr *scp.RemoteError
+	if !errors.As(err, &remoteErr) || errors.Is(err, scp.ErrConnectionClosed) {
+		t.Errorf("Expected a remote error, got %v", err)
+	}
+}
+
+func TestCopyBetween(t *testing.T) {
+	src := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0640 11 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello world\x00")
+		stdin.Read(ack)
+		return 0
+	})
+	defer src.Close()
+
+	records := make(chan string, 1)
+	received := make(chan string, 1)
+	dst := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		record, _ := reader.ReadString('\n')
+		records <- record
+		stdout.Write([]byte{0})
+		contents := make([]byte, 11)
+		io.ReadFull(reader, contents)
+		received <- string(contents)
+		reader.ReadByte()
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer dst.Close()
+
+	err := scp.CopyBetween(context.Background(), &src, "/data/file.txt", &dst, "/backup/file.txt", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if record := <-records; record != "C0640 11 file.txt\n" {
+		t.Errorf("Expected the permissions and size of the source, got %q", record)
+	}
+	if contents := <-received; contents != "hello world" {
+		t.Errorf("Expected %q, got %q", "hello world", contents)
+	}
+}
+
+// TestCopyBetweenSameClient tests that a copy between two paths on the same client, which only
+// allows a single session, does not wait for the session of the download.
+func TestCopyBetweenSameClient(t *testing.T) {
+	received := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if strings.Contains(command, " -pf ") || strings.Contains(command, " -f ") {
+			ack := make([]byte, 1)
+			stdin.Read(ack)
+			fmt.Fprint(stdout, "C0640 11 file.txt\n")
+			stdin.Read(ack)
+			fmt.Fprint(stdout, "hello world\x00")
+			stdin.Read(ack)
+			return 0
+		}
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		record, _ := reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		contents := make([]byte, 11)
+		io.ReadFull(reader, contents)
+		received <- record + string(contents)
+		reader.ReadByte()
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := scp.CopyBetween(ctx, &client, "/data/file.txt", &client, "/backup/file.txt", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if upload := <-received; upload != "C0640 11 file.txt\nhello world" {
+		t.Errorf("Expected the file to be copied, got %q", upload)
+	}
+}
+
+// serveFakeSFTP answers the requests of the SFTP fallback for a regular file of `size` bytes,
+// and reports the types of the requests it received.
+func serveFakeSFTP(stdin io.Reader, stdout io.Writer, size uint64, requests chan<- byte) {
+	reply := func(packetType byte, id uint32, payload []byte) {
+		packet := binary.BigEndian.AppendUint32([]byte{packetType}, id)
+		packet = append(packet, payload...)
+		stdout.Write(binary.BigEndian.AppendUint32(nil, uint32(len(packet))))
+		stdout.Write(packet)
+	}
+	status := func(code uint32) []byte {
+		return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, code), 0), 0)
+	}
+
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(stdin, header[:]); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint32(header[:4])-1)
+		if _, err := io.ReadFull(stdin, packet); err != nil {
+			return
+		}
+		requests <- header[4]
+
+		switch header[4] {
+		case 1: // init, answered with version 3
+			stdout.Write([]byte{0, 0, 0, 5, 2, 0, 0, 0, 3})
+			continue
+		}
+
+		id := binary.BigEndian.Uint32(packet)
+		switch header[4] {
+		case 3: // open
+			reply(102, id, []byte{0, 0, 0, 1, 'h'})
+		case 8: // fstat, answered with the size and permissions
+			attrs := binary.BigEndian.AppendUint32(nil, 0x01|0x04)
+			attrs = binary.BigEndian.AppendUint64(attrs, size)
+			attrs = binary.BigEndian.AppendUint32(attrs, 0100644)
+			reply(105, id, attrs)
+		case 5: // read, answered with the end of the file
+			reply(101, id, status(1))
+		default:
+			reply(101, id, status(0))
+		}
+	}
+}
+
+// TestMaxFileSizeSFTP tests that the maximum file size also applies when falling back to SFTP.
+func TestMaxFileSizeSFTP(t *testing.T) {
+	requests := make(chan byte, 16)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if command == "subsystem sftp" {
+			serveFakeSFTP(stdin, stdout, 1<<40, requests)
+			return 0
+		}
+		fmt.Fprint(stderr, "bash: scp: command not found\n")
+		return 127
+	})
+	defer client.Close()
+	client.SFTPFallback = true
+	client.MaxFileSize = 1 << 30
+
+	err := client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/huge.img", nil)
+	if !errors.Is(err, scp.ErrFileTooLarge) {
+		t.Errorf("Expected %v, got %v", scp.ErrFileTooLarge, err)
+	}
+	close(requests)
+	for request := range requests {
+		if request == 5 {
+			t.Errorf("Expected the contents not to be requested")
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	responses := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 4398046511104 huge.img\n")
+		response, _ := bufio.NewReader(stdin).ReadString('\n')
+		responses <- response
+		return 1
+	})
+	defer client.Close()
+	client.MaxFileSize = 1 << 20
+
+	var buf bytes.Buffer
+	err := client.CopyFromRemotePassThru(context.Background(), &buf, "/data/huge.img", nil)
+	if !errors.Is(err, scp.ErrFileTooLarge) {
+		t.Errorf("Expected %v, got %v", scp.ErrFileTooLarge, err)
+	}
+	if response := <-responses; !strings.HasPrefix(response, "\x02") {
+		t.Errorf("Expected the transfer to be aborted, got %q", response)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be written, got %d bytes", buf.Len())
+	}
+}
+
+// TestCancelAfterContents tests that a download still honours the context when the remote
+// hangs after sending the contents, instead of exiting.
+func TestCancelAfterContents(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 5 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello\x00")
+		stdin.Read(ack)
+		<-hang
+		return 0
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.CopyFromRemotePassThru(ctx, io.Discard, "/data/file.txt", nil)
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the download to stop once the context was done")
+	}
+}
+
+// cancelWriter cancels the context after the first write, and records writes made after the
+// call it is passed to returned.
+type cancelWriter struct {
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	returned bool
+	late     int
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.returned {
+		w.late += len(p)
+	}
+	w.cancel()
+	return len(p), nil
+}
+
+// TestCancelMidBody tests that a download stops once the context is cancelled while the remote
+// is sending the contents, and that nothing is written after it returned.
+func TestCancelMidBody(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 10 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello")
+		<-hang
+		fmt.Fprint(stdout, "world\x00")
+		return 0
+	})
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &cancelWriter{cancel: cancel}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.CopyFromRemotePassThru(ctx, w, "/data/file.txt", nil)
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the download to stop once the context was cancelled")
+	}
+
+	w.mu.Lock()
+	w.returned = true
+	w.mu.Unlock()
+	hang <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.late != 0 {
+		t.Errorf("Expected nothing to be written after the download returned, got %d bytes", w.late)
+	}
+}
+
+// TestCountOnTimeout tests that the bytes written before a download was aborted are counted.
+func TestCountOnTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 10 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello")
+		<-hang
+		return 0
+	})
+	defer client.Close()
+	client.ResponseTimeout = 200 * time.Millisecond
+
+	var buf bytes.Buffer
+	n, err := client.CopyFromRemoteCount(context.Background(), &buf, "/data/file.txt", nil)
+	if !errors.Is(err, scp.ErrResponseTimeout) {
+		t.Errorf("Expected %v, got %v", scp.ErrResponseTimeout, err)
+	}
+	if n != 5 || buf.String() != "hello" {
+		t.Errorf("Expected 5 bytes to be counted, got %d for %q", n, buf.String())
+	}
+}
+
+// TestSFTPFallbackWrapper tests that a transfer only falls back to SFTP when the scp binary run
+// through a wrapper is missing, not when the wrapper itself is.
+func TestSFTPFallbackWrapper(t *testing.T) {
+	for stderr, fallback := range map[string]bool{
+		"bash: sudo: command not found\n":    false,
+		"sudo: scp: command not found\n":     true,
+		"bash: line 1: scp: not found\n":     true,
+		"bash: /opt/sudo: Permission denied": false,
+	} {
+		commands := make(chan string, 2)
+		client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderrW io.Writer) int {
+			commands <- command
+			if strings.HasPrefix(command, "subsystem ") {
+				return 1
+			}
+			fmt.Fprint(stderrW, stderr)
+			return 127
+		})
+		client.SFTPFallback = true
+
+		err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644", scp.WithRemoteBinary("sudo -n scp"))
+		if err == nil {
+			t.Errorf("%q: Expected an error", stderr)
+		}
+		client.Close()
+
+		<-commands
+		if sftp := len(commands) == 1 && <-commands == "subsystem sftp"; sftp != fallback {
+			t.Errorf("%q: Expected the fallback to SFTP to be %v, got %v", stderr, fallback, sftp)
+		}
+	}
+}
+
+// TestSFTPFallbackSessionLimit tests that the fallback to SFTP does not wait for the session of
+// the failed scp attempt with the default limit of sessions.
+func TestSFTPFallbackSessionLimit(t *testing.T) {
+	commands := make(chan string, 2)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		if strings.HasPrefix(command, "subsystem ") {
+			return 1
+		}
+		fmt.Fprint(stderr, "bash: scp: command not found\n")
+		return 127
+	})
+	defer client.Close()
+	client.SFTPFallback = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := client.CopyFromRemotePassThru(ctx, io.Discard, "/data/file.txt", nil)
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the fallback to fail on the fake remote, got %v", err)
+	}
+
+	<-commands
+	if command := <-commands; command != "subsystem sftp" {
+		t.Errorf("Expected the download to fall back to SFTP, got %q", command)
+	}
+}
+
+func TestUseSubsystem(t *testing.T) {
+	commands := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+	client.UseSubsystem = "scp-appliance"
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if command := <-commands; command != "subsystem scp-appliance" {
+		t.Errorf("Expected the subsystem to be requested, got %q", command)
+	}
+}
+
+// TestFileInfosOnFailure tests that the file infos announced by the remote are returned
+// when the transfer of the contents fails.
+func TestFileInfosOnFailure(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "T1700000000 0 1700000000 0\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 2000000000 foo.bin\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "partial")
+		fmt.Fprint(stderr, "scp: read error\n")
+		return 1
+	})
+	defer client.Close()
+
+	info, err := client.CopyFromRemoteFileInfos(context.Background(), io.Discard, "/data/foo.bin", nil)
+	if err == nil {
+		t.Fatalf("Expected error thrown. Got nil")
+	}
+	if info == nil {
+		t.Fatalf("Expected the file infos to be returned alongside %v", err)
+	}
+	if info.Filename != "foo.bin" || info.Size != 2000000000 || info.Mtime != 1700000000 {
+		t.Errorf("Expected the announced file infos, got %+v", info)
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	commands := make(chan string, 2)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		fmt.Fprint(stderr, "Sink: C0644 5 file.txt\n")
+		return 1
+	})
+	defer client.Close()
+	client.Verbose = true
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if command := <-commands; command != client.RemoteBinary+" -vt '/data'" {
+		t.Errorf("Expected the quiet flag to be replaced, got %q", command)
+	}
+	var remoteErr *scp.RemoteError
+	if !errors.As(err, &remoteErr) || !strings.Contains(remoteErr.Stderr, "Sink:") {
+		t.Errorf("Expected the diagnostics of the remote in the error, got %v", err)
+	}
+
+	client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/file.txt", nil)
+	if command := <-commands; command != client.RemoteBinary+" -vf '/data/file.txt'" {
+		t.Errorf("Expected the verbose flag to be added, got %q", command)
+	}
+}
+
+func TestOnProgress(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		record, _ := reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		var mode, size int64
+		fmt.Sscanf(record, "C%o %d", &mode, &size)
+		io.CopyN(io.Discard, reader, size+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+	client.BufferSize = 4
+
+	var calls [][2]int64
+	client.OnProgress = func(bytesSoFar, total int64) {
+		calls = append(calls, [2]int64{bytesSoFar, total})
+	}
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello world"), "/data/file.txt", "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "[[4 11] [8 11] [11 11]]"; fmt.Sprint(calls) != expected {
+		t.Errorf("Expected %v, got %v", expected, calls)
+	}
+
+	calls = nil
+	err = client.CopyFile(context.Background(), strings.NewReader(""), "/data/empty.txt", "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "[[0 0]]"; fmt.Sprint(calls) != expected {
+		t.Errorf("Expected %v for an empty file, got %v", expected, calls)
+	}
+}
+
+func TestCopyFromFileWithSize(t *testing.T) {
+	records := make(chan string, 1)
+	received := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		record, _ := reader.ReadString('\n')
+		records <- record
+		stdout.Write([]byte{0})
+		contents := make([]byte, 5)
+		io.ReadFull(reader, contents)
+		received <- string(contents)
+		reader.ReadByte()
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+
+	f, err := os.CreateTemp(t.TempDir(), "upload")
+	if err != nil {
+		t.Fatalf("Couldn't create a local file: %v", err)
+	}
+	defer f.Close()
+	f.WriteString("hello world")
+	f.Seek(0, io.SeekStart)
+
+	if err := client.CopyFromFileWithSize(context.Background(), f, "/data/file.txt", "0644", -1); err == nil {
+		t.Errorf("Expected a negative size to be rejected")
+	}
+
+	if err := client.CopyFromFileWithSize(context.Background(), f, "/data/file.txt", "0644", 5); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if record := <-records; record != "C0644 5 file.txt\n" {
+		t.Errorf("Expected only the first 5 bytes to be announced, got %q", record)
+	}
+	if contents := <-received; contents != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", contents)
+	}
+}
+
+func TestRemoteCommand(t *testing.T) {
+	commands := make(chan string, 4)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		if strings.Contains(command, "chown") {
+			return 0
+		}
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+
+	client.RemoteCommand = []string{"/opt/my tools/scp"}
+	if err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if command := <-commands; command != "'/opt/my tools/scp' -qt '/data'" {
+		t.Errorf("Expected the path of the binary to be quoted, got %q", command)
+	}
+
+	client.RemoteCommand = nil
+	client.RemoteBinary = "sudo -n scp"
+	err := client.CopyFileWithOwner(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644", "www", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if command := <-commands; command != "sudo -n scp -qt '/data'" {
+		t.Errorf("Unexpected scp command %q", command)
+	}
+	if command := <-commands; command != "sudo -n chown -- 'www' '/data/file.txt'" {
+		t.Errorf("Expected chown to be run through the same wrapper, got %q", command)
+	}
+}
+
+// recordSink acknowledges every record sent to a fake `scp -t`, skipping the contents of
+// files, and returns the records it received.
+func recordSink(stdin io.Reader, stdout io.Writer) []string {
+	stdout.Write([]byte{0})
+	reader := bufio.NewReader(stdin)
+	var records []string
+	for {
+		record, err := reader.ReadString('\n')
+		if err != nil {
+			return records
+		}
+		records = append(records, record)
+		stdout.Write([]byte{0})
+
+		if strings.HasPrefix(record, "C") {
+			var mode string
+			var size int64
+			fmt.Sscanf(record, "C%s %d", &mode, &size)
+			io.CopyN(io.Discard, reader, size+1)
+			stdout.Write([]byte{0})
+		}
+	}
+}
+
+func TestSymlinkMode(t *testing.T) {
+	localDir := t.TempDir()
+	os.WriteFile(filepath.Join(localDir, "file.txt"), []byte("hello"), 0644)
+	os.Symlink("file.txt", filepath.Join(localDir, "link.txt"))
+	os.Mkdir(filepath.Join(localDir, "sub"), 0755)
+	os.Symlink("sub", filepath.Join(localDir, "sublink"))
+
+	records := make(chan []string, 1)
+	commands := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if strings.Contains(command, "scp") {
+			records <- recordSink(stdin, stdout)
+		} else {
+			commands <- command
+		}
+		return 0
+	})
+	defer client.Close()
+
+	upload := func(mode scp.SymlinkMode) (string, error) {
+		err := client.CopyDirToRemote(context.Background(), localDir, "/srv/app", &scp.DirOptions{SymlinkMode: mode})
+		var entries []string
+		for _, record := range <-records {
+			entry := record[:1]
+			if fields := strings.Fields(record); len(fields) == 3 {
+				entry += fields[2]
+			}
+			entries = append(entries, entry)
+		}
+		return strings.Join(entries, " "), err
+	}
+
+	if entries, err := upload(scp.SymlinkSkip); err != nil || entries != "Dapp Cfile.txt Dsub E E" {
+		t.Errorf("Expected the symbolic links to be skipped, got %q: %v", entries, err)
+	}
+
+	if entries, err := upload(scp.SymlinkFollow); err != nil || entries != "Dapp Cfile.txt Clink.txt Dsub E Dsublink E E" {
+		t.Errorf("Expected the symbolic links to be followed, got %q: %v", entries, err)
+	}
+
+	if entries, err := upload(scp.SymlinkRecreate); err != nil || entries != "Dapp Cfile.txt Dsub E E" {
+		t.Errorf("Expected only the files to be sent, got %q: %v", entries, err)
+	}
+	expected := "ln -sfn -- 'file.txt' '/srv/app/link.txt' && ln -sfn -- 'sub' '/srv/app/sublink'"
+	if command := <-commands; command != expected {
+		t.Errorf("Expected the symbolic links to be recreated with %q, got %q", expected, command)
+	}
+
+	os.Symlink("..", filepath.Join(localDir, "sub", "loop"))
+	err := client.CopyDirToRemote(context.Background(), localDir, "/srv/app", &scp.DirOptions{SymlinkMode: scp.SymlinkFollow})
+	if err == nil || !strings.Contains(err.Error(), "loop") {
+		t.Errorf("Expected the symbolic link loop to be detected, got %v", err)
+	}
+}
+
+func TestChmod(t *testing.T) {
+	commands := make(chan string, 2)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		if strings.Contains(command, "missing") {
+			fmt.Fprint(stderr, "chmod: cannot access '/data/missing': No such file or directory\n")
+			return 1
+		}
+		return 0
+	})
+	defer client.Close()
+	client.RemoteBinary = "sudo scp"
+
+	if err := client.Chmod(context.Background(), "/data/it's.txt", 0600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if command := <-commands; command != `sudo chmod 0600 -- '/data/it'\''s.txt'` {
+		t.Errorf("Unexpected command %q", command)
+	}
+
+	err := client.Chmod(context.Background(), "/data/missing", 0600)
+	var remoteErr *scp.RemoteError
+	if !errors.As(err, &remoteErr) || !strings.Contains(remoteErr.Stderr, "No such file") {
+		t.Errorf("Expected a remote error holding the output of chmod, got %v", err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		<-hang
+		return 0
+	})
+	defer client.Close()
+	client.CommandTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	err := client.Chmod(context.Background(), "/data/file.txt", 0600)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "chmod") {
+		t.Errorf("Expected the chmod command to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the command to be stopped after the timeout, took %s", elapsed)
+	}
+}
+
+func TestResumeState(t *testing.T) {
+	received := make(chan string, 4)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		switch {
+		case strings.Contains(command, " -prf "):
+			ack := make([]byte, 1)
+			stdin.Read(ack)
+			fmt.Fprint(stdout, "C0644 6 file.txt\n")
+			stdin.Read(ack)
+			fmt.Fprint(stdout, "hello \x00")
+			stdin.Read(ack)
+		case strings.HasPrefix(command, "tee -a "):
+			data, _ := io.ReadAll(stdin)
+			received <- command + "|" + string(data)
+		default:
+			stdout.Write([]byte{0})
+			reader := bufio.NewReader(stdin)
+			record, _ := reader.ReadString('\n')
+			stdout.Write([]byte{0})
+			var mode, size int64
+			fmt.Sscanf(record, "C%o %d", &mode, &size)
+			data := make([]byte, size+1)
+			io.ReadFull(reader, data)
+			received <- record + string(data[:size])
+			stdout.Write([]byte{0})
+		}
+		return 0
+	})
+	defer client.Close()
+
+	dir := t.TempDir()
+	client.ResumeState = filepath.Join(dir, "upload.scp-progress")
+	f, err := os.Create(filepath.Join(dir, "file.txt"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer f.Close()
+	f.WriteString("hello world")
+	f.Seek(0, io.SeekStart)
+	stat, _ := f.Stat()
+
+	// A new upload starts with an empty remote file
+	if err := client.CopyFromFile(context.Background(), f, "/data/file.txt", "0644"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, expected := range []string{"C0644 0 file.txt\n", "C0644 11 file.txt\nhello world"} {
+		if upload := <-received; upload != expected {
+			t.Errorf("Expected %q, got %q", expected, upload)
+		}
+	}
+	if _, err := os.Stat(client.ResumeState); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the resume state to be removed after the upload, got %v", err)
+	}
+
+	// An interrupted upload of which the remote received 6 bytes is resumed from there
+	state := fmt.Sprintf(`{"remotePath":"/data/file.txt","size":11,"modTime":%q,"sent":8}`, stat.ModTime().Format(time.RFC3339Nano))
+	if err := os.WriteFile(client.ResumeState, []byte(state), 0600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f.Seek(0, io.SeekStart)
+	if err := client.CopyFromFile(context.Background(), f, "/data/file.txt", "0644"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "tee -a -- '/data/file.txt' >/dev/null|world"; len(received) == 0 || <-received != expected {
+		t.Errorf("Expected the upload to be resumed with %q", expected)
+	}
+	if _, err := os.Stat(client.ResumeState); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the resume state to be removed after the upload, got %v", err)
+	}
+}
+
+// TestAppendToRemoteWrapper tests that the file is appended to by the wrapper the scp binary
+// is run through, rather than by the login shell redirecting its output.
+func TestAppendToRemoteWrapper(t *testing.T) {
+	received := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if strings.Contains(command, " -prf ") {
+			ack := make([]byte, 1)
+			stdin.Read(ack)
+			fmt.Fprint(stdout, "C0644 5 file.txt\n")
+			stdin.Read(ack)
+			fmt.Fprint(stdout, "hello\x00")
+			stdin.Read(ack)
+			return 0
+		}
+		data, _ := io.ReadAll(stdin)
+		received <- command + "|" + string(data)
+		return 0
+	})
+	defer client.Close()
+
+	r := strings.NewReader("hello world")
+	r.Seek(5, io.SeekStart)
+	err := client.AppendToRemote(context.Background(), r, "/data/file.txt", 6, scp.WithRemoteBinary("sudo -n scp"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "sudo -n tee -a -- '/data/file.txt' >/dev/null| world"; <-received != expected {
+		t.Errorf("Expected %q to be run", expected)
+	}
+}
+
+func TestRejectDirTarget(t *testing.T) {
+	uploads := make(chan string, 2)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		switch {
+		case strings.HasSuffix(command, " -prf '/data/dir'"):
+			stdin.Read(ack)
+			fmt.Fprint(stdout, "D0755 0 dir\n")
+			stdin.Read(ack)
+			fmt.Fprint(stdout, "E\n")
+			stdin.Read(ack)
+		case strings.Contains(command, " -prf "):
+			stdin.Read(ack)
+			fmt.Fprint(stdout, "\x01scp: /data/file.txt: No such file or directory\n")
+			return 1
+		default:
+			uploads <- command
+			stdout.Write([]byte{0})
+			reader := bufio.NewReader(stdin)
+			reader.ReadString('\n')
+			stdout.Write([]byte{0})
+			io.CopyN(io.Discard, reader, 5+1)
+			stdout.Write([]byte{0})
+		}
+		return 0
+	})
+	defer client.Close()
+	client.RejectDirTarget = true
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/dir", "0644")
+	if !errors.Is(err, scp.ErrRemoteIsDirectory) {
+		t.Errorf("Expected %v, got %v", scp.ErrRemoteIsDirectory, err)
+	}
+	if len(uploads) != 0 {
+		t.Errorf("Expected nothing to be uploaded, got %q", <-uploads)
+	}
+
+	err = client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if command := <-uploads; command != client.RemoteBinary+" -qt '/data'" {
+		t.Errorf("Unexpected upload command %q", command)
+	}
+}
+
+func TestIsConnected(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		return 0
+	})
+	if !client.IsConnected() {
+		t.Errorf("Expected the client to be connected")
+	}
+
+	client.Close()
+	if client.IsConnected() {
+		t.Errorf("Expected the client not to be connected after closing it")
+	}
+
+	idle := scp.NewClient("127.0.0.1:22", &ssh.ClientConfig{})
+	if idle.IsConnected() {
+		t.Errorf("Expected a new client not to be connected")
+	}
+}
+
+// freezingConn stops delivering what the remote sends once frozen, like a connection that
+// was silently dropped, until it is closed.
+type freezingConn struct {
+	net.Conn
+	frozen    atomic.Bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *freezingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.frozen.Load() {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *freezingConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestReconnectDroppedConnection(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		stdout.Write([]byte{0})
+		return 0
+	})
+	defer client.Close()
+
+	var mu sync.Mutex
+	var conns []*freezingConn
+	dial := client.Dialer
+	client.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fc := &freezingConn{Conn: conn, closed: make(chan struct{})}
+		conns = append(conns, fc)
+		return fc, nil
+	}
+	client.Close()
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	client.AutoReconnect = true
+	client.ResponseTimeout = 200 * time.Millisecond
+
+	mu.Lock()
+	conns[0].frozen.Store(true)
+	mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.CopyFile(ctx, strings.NewReader("hello"), "/data/file.txt", "0644"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 2 {
+		t.Errorf("Expected the dropped connection to be dialed again, got %d connections", len(conns))
+	}
+}
+
+// fixedPermissionsProtocol parses records like OpenSSH, but ignores the permissions sent.
+type fixedPermissionsProtocol struct {
+	scp.OpenSSHProtocol
+}
+
+func (p fixedPermissionsProtocol) ParseResponse(reader io.Reader, writer io.Writer) (*scp.FileInfos, error) {
+	fileInfos, err := p.OpenSSHProtocol.ParseResponse(reader, writer)
+	if err == nil {
+		fileInfos.Permissions = 0600
+	}
+	return fileInfos, err
+}
+
+func TestProtocol(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "C0644 5 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello\x00")
+		stdin.Read(ack)
+		return 0
+	})
+	defer client.Close()
+	client.Protocol = fixedPermissionsProtocol{}
+
+	info, err := client.CopyFromRemoteFileInfos(context.Background(), io.Discard, "/data/file.txt", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Permissions != 0600 {
+		t.Errorf("Expected the records to be parsed by the protocol, got permissions %o", info.Permissions)
+	}
+}
+
+func TestFailOnWarning(t *testing.T) {
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if strings.Contains(command, " -prf ") {
+			stdin.Read(make([]byte, 1))
+			fmt.Fprint(stdout, "D0755 0 dir\n")
+			stdin.Read(make([]byte, 1))
+			fmt.Fprint(stdout, "\x01scp: /data/dir/secret: Permission denied\n")
+			fmt.Fprint(stdout, "C0644 5 file.txt\n")
+			stdin.Read(make([]byte, 1))
+			fmt.Fprint(stdout, "hello\x00")
+			stdin.Read(make([]byte, 1))
+			fmt.Fprint(stdout, "E\n")
+			stdin.Read(make([]byte, 1))
+			return 0
+		}
+
+		stdout.Write([]byte{0})
+		reader := bufio.NewReader(stdin)
+		reader.ReadString('\n')
+		stdout.Write([]byte{0})
+		io.CopyN(io.Discard, reader, 5+1)
+		fmt.Fprint(stdout, "\x01scp: /data/file.txt: set times: Operation not permitted\n")
+		return 0
+	})
+	defer client.Close()
+
+	err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644")
+	if !errors.Is(err, scp.ErrRemoteWarning) {
+		t.Errorf("Expected %v, got %v", scp.ErrRemoteWarning, err)
+	}
+
+	var warnings []string
+	client.WarningHandler = func(message string) {
+		warnings = append(warnings, message)
+	}
+	client.FailOnWarning = false
+
+	if err := client.CopyFile(context.Background(), strings.NewReader("hello"), "/data/file.txt", "0644"); err != nil {
+		t.Errorf("Expected the upload to continue past the warning, got %v", err)
+	}
+
+	var files []string
+	err = client.WalkRemote(context.Background(), "/data/dir", func(info scp.FileInfos) error {
+		files = append(files, info.Path)
+		return nil
+	})
+	if err != nil || strings.Join(files, " ") != "/data/dir /data/dir/file.txt" {
+		t.Errorf("Expected the download to skip the unreadable file, got %v: %v", files, err)
+	}
+
+	expected := "scp: /data/file.txt: set times: Operation not permitted|scp: /data/dir/secret: Permission denied"
+	if strings.Join(warnings, "|") != expected {
+		t.Errorf("Expected the warnings to be handled, got %q", warnings)
+	}
+}
+
+func TestMaxConcurrentSessions(t *testing.T) {
+	var open, maxOpen atomic.Int32
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		n := open.Add(1)
+		defer open.Add(-1)
+		for {
+			max := maxOpen.Load()
+			if n <= max || maxOpen.CompareAndSwap(max, n) {
+				break
+			}
+		}
+
+		ack := make([]byte, 1)
+		stdin.Read(ack)
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(stdout, "C0644 5 file.txt\n")
+		stdin.Read(ack)
+		fmt.Fprint(stdout, "hello\x00")
+		stdin.Read(ack)
+		return 0
+	})
+	defer client.Close()
+	if client.MaxConcurrentSessions != 1 {
+		t.Errorf("Expected a default of 1 session at the same time, got %d", client.MaxConcurrentSessions)
+	}
+
+	for _, limit := range []int{1, 2} {
+		client.MaxConcurrentSessions = limit
+		maxOpen.Store(0)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- client.CopyFromRemotePassThru(context.Background(), io.Discard, "/data/file.txt", nil)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}
+		if maxOpen.Load() > int32(limit) {
+			t.Errorf("Expected at most %d sessions at the same time, got %d", limit, maxOpen.Load())
+		}
+	}
+}
+
+func TestCommandMarshalText(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	cases := []struct {
+		command scp.Command
+		record  string
+	}{
+		{scp.Command{Type: scp.Create, Mode: 0644, Size: 5, Name: "file.txt"}, "C0644 5 file.txt"},
+		{scp.Command{Type: scp.Directory, Mode: 0755, Name: "dir"}, "D0755 0 dir"},
+		{scp.Command{Type: scp.EndDirectory}, "E"},
+		{scp.Command{Type: scp.Time, Mtime: mtime}, "T1700000000 0 1700000000 0"},
+
+		// The mode is always sent as four octal digits, as OpenSSH does
+		{scp.Command{Type: scp.Create, Mode: 0, Size: 5, Name: "file.txt"}, "C0000 5 file.txt"},
+		{scp.Command{Type: scp.Create, Mode: 0755, Size: 5, Name: "file.txt"}, "C0755 5 file.txt"},
+		{scp.Command{Type: scp.Create, Mode: 0777, Size: 5, Name: "file.txt"}, "C0777 5 file.txt"},
+		{scp.Command{Type: scp.Create, Mode: os.ModePerm, Size: 5, Name: "file.txt"}, "C0777 5 file.txt"},
+		{scp.Command{Type: scp.Create, Mode: 0755 | os.ModeSetuid, Size: 5, Name: "file.txt"}, "C4755 5 file.txt"},
+		{scp.Command{Type: scp.Directory, Mode: os.ModeDir | 0700, Name: "dir"}, "D0700 0 dir"},
+	}
+	for _, c := range cases {
+		record, err := c.command.MarshalText()
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", c.record, err)
+		} else if string(record) != c.record {
+			t.Errorf("Expected %q, got %q", c.record, record)
+		}
+	}
+
+	_, err := scp.Command{Type: scp.Create, Size: 5, Name: "dir/file.txt"}.MarshalText()
+	if !errors.Is(err, scp.ErrInvalidFilename) {
+		t.Errorf("Expected %v, got %v", scp.ErrInvalidFilename, err)
+	}
+}
+
+func TestCommandUnmarshalText(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	cases := []struct {
+		record  string
+		command scp.Command
+	}{
+		{"C0644 5 file.txt\n", scp.Command{Type: scp.Create, Mode: 0644, Size: 5, Name: "file.txt"}},
+		{"C4755 8589934592 large.bin\r\n", scp.Command{Type: scp.Create, Mode: 0755 | os.ModeSetuid, Size: 8589934592, Name: "large.bin"}},
+		{"D0755 0 dir", scp.Command{Type: scp.Directory, Mode: 0755, Name: "dir"}},
+		{"E\n", scp.Command{Type: scp.EndDirectory}},
+		{"T1700000000 0 1700000000 0\n", scp.Command{Type: scp.Time, Mtime: mtime, Atime: mtime}},
+	}
+	for _, c := range cases {
+		var command scp.Command
+		if err := command.UnmarshalText([]byte(c.record)); err != nil {
+			t.Errorf("Unexpected error for %q: %v", c.record, err)
+		} else if command.Type != c.command.Type || command.Mode != c.command.Mode || command.Size != c.command.Size ||
+			command.Name != c.command.Name || !command.Mtime.Equal(c.command.Mtime) || !command.Atime.Equal(c.command.Atime) {
+			t.Errorf("Expected %+v for %q, got %+v", c.command, c.record, command)
+		}
+	}
+
+	errorCases := []struct {
+		record string
+		offset int
+	}{
+		{"C0644 large foo.bin\n", 6},
+		{"C0899 5 foo.bin\n", 1},
+		{"C0644 5\n", 7},
+		{"T1700000000 0 17 0\n", 14},
+		{"X0644 5 foo.bin\n", 0},
+	}
+	for _, c := range errorCases {
+		var command scp.Command
+		err := command.UnmarshalText([]byte(c.record))
+		var protocolErr *scp.ProtocolError
+		if !errors.As(err, &protocolErr) {
+			t.Errorf("Expected a ProtocolError for %q, got %v", c.record, err)
+		} else if protocolErr.Line != c.record || protocolErr.Offset != c.offset {
+			t.Errorf("Expected offset %d of %q, got offset %d of %q", c.offset, c.record, protocolErr.Offset, protocolErr.Line)
+		}
+	}
+
+	// ParseFileInfos and ParseFileTime parse the records the same way
+	fileInfos := scp.NewFileInfos()
+	if err := scp.ParseFileInfos("C0644 8589934592 large.bin\n", fileInfos); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := scp.ParseFileTime("1700000000 0 1700000001 0\n", fileInfos); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fileInfos.Permissions != 0644 || fileInfos.Size != 8589934592 || fileInfos.Filename != "large.bin" ||
+		fileInfos.Mtime != 1700000000 || fileInfos.Atime != 1700000001 {
+		t.Errorf("Unexpected file infos %+v", fileInfos)
+	}
+}
+
+func TestBeginUpload(t *testing.T) {
+	commands := make(chan string, 1)
+	received := make(chan string, 1)
+	client := connectFakeRemote(t, func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		commands <- command
+		var log strings.Builder
+		reader := bufio.NewReader(stdin)
+		stdout.Write([]byte{0})
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			log.WriteString(line)
+			if strings.HasPrefix(line, "C") {
+				var mode, name string
+				var size int64
+				fmt.Sscanf(line, "%s %d %s", &mode, &size, &name)
+				stdout.Write([]byte{0})
+				body := make([]byte, size+1)
+				io.ReadFull(reader, body)
+				log.Write(body[:size])
+				log.WriteString("\n")
+			}
+			stdout.Write([]byte{0})
+		}
+		received <- log.String()
+		return 0
+	})
+	defer client.Close()
+
+	transfer, err := client.BeginUpload(context.Background(), "/data")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	send := func(command scp.Command, body string) {
+		t.Helper()
+		if err := transfer.SendCommand(command); err != nil {
+			t.Fatalf("Unexpected error sending %v: %v", command, err)
+		}
+		if _, err := transfer.ReadResponse(); err != nil {
+			t.Fatalf("Unexpected response to %v: %v", command, err)
+		}
+		if command.Type != scp.Create {
+			return
+		}
+		if err := transfer.WriteBody(strings.NewReader(body)); err != nil {
+			t.Fatalf("Unexpected error sending the contents: %v", err)
+		}
+		if _, err := transfer.ReadResponse(); err != nil {
+			t.Fatalf("Unexpected response to the contents: %v", err)
+		}
+	}
+	send(scp.Command{Type: scp.Directory, Mode: 0755, Name: "dir"}, "")
+	// The mask applies to the low-level API like to every other upload
+	client.PermissionMask = 0755
+	send(scp.Command{Type: scp.Create, Mode: 0666, Size: 5, Name: "file.txt"}, "hello")
+	send(scp.Command{Type: scp.EndDirectory}, "")
+
+	if err := transfer.Close(); err != nil {
+		t.Fatalf("Unexpected error closing the transfer: %v", err)
+	}
+	if command := <-commands; command != client.RemoteBinary+" -qrt '/data'" {
+		t.Errorf("Unexpected command %q", command)
+	}
+	expected := "D0755 0 dir\nC0644 5 file.txt\nhello\nE\n"
+	if log := <-received; log != expected {
+		t.Errorf("Expected %q, got %q", expected, log)
+	}
+}
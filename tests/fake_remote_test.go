@@ -0,0 +1,120 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/bramvdbogaerde/go-scp"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeRemote handles a command executed on the fake remote, the returned
+// value is used as the exit status of the command. A negative value closes
+// the session without sending an exit status.
+type fakeRemote func(command string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// connectFakeRemote starts an in-process SSH server that runs every command
+// it receives through the handler, instead of running an actual scp binary,
+// and returns a client connected to it.
+func connectFakeRemote(t testing.TB, handler fakeRemote) scp.Client {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate a host key: %s", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("Couldn't create a host key signer: %s", err)
+	}
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen for connections: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeRemote(conn, serverConfig, handler)
+		}
+	}()
+
+	client := scp.NewClient("fake-remote:22", &ssh.ClientConfig{
+		User:            "bram",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+
+	// The fake remote is not reachable through its host name
+	client.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, listener.Addr().String())
+	}
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Couldn't establish a connection to the fake remote: %s", err)
+	}
+	return client
+}
+
+func serveFakeRemote(conn net.Conn, config *ssh.ServerConfig, handler fakeRemote) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range requests {
+				if req.Type != "exec" && req.Type != "subsystem" {
+					req.Reply(false, nil)
+					continue
+				}
+
+				// Subsystems are passed to the handler as "subsystem <name>"
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				if req.Type == "subsystem" {
+					payload.Command = "subsystem " + payload.Command
+				}
+				req.Reply(true, nil)
+
+				go func() {
+					status := handler(payload.Command, channel, channel, channel.Stderr())
+					if status < 0 {
+						channel.Close()
+						return
+					}
+
+					exitStatus := make([]byte, 4)
+					binary.BigEndian.PutUint32(exitStatus, uint32(status))
+					channel.SendRequest("exit-status", false, exitStatus)
+					channel.Close()
+				}()
+			}
+		}()
+	}
+}
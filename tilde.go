@@ -0,0 +1,47 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// remoteUserPattern matches the user names that can safely be expanded by the remote shell.
+var remoteUserPattern = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
+// expandTilde replaces a leading "~" or "~user" in the remote path with the home directory
+// of the login user or of the named user when `ExpandTilde` is set, by asking the remote
+// shell to expand it. Other remote paths are returned unchanged.
+func (a *Client) expandTilde(ctx context.Context, remotePath string) (string, error) {
+	if !a.ExpandTilde || !strings.HasPrefix(remotePath, "~") {
+		return remotePath, nil
+	}
+
+	prefix, rest, hasRest := strings.Cut(remotePath, "/")
+	if !remoteUserPattern.MatchString(prefix[1:]) {
+		return "", fmt.Errorf("invalid user name in remote path: %q", remotePath)
+	}
+
+	output, err := a.runRemote(ctx, "printf '%s\\n' "+prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand %q on the remote: %w", prefix, err)
+	}
+
+	// The shell leaves the tilde as it is if the user does not exist
+	home := strings.TrimSuffix(string(output), "\n")
+	if home == "" || strings.HasPrefix(home, "~") {
+		return "", fmt.Errorf("failed to expand %q on the remote: unknown user", prefix)
+	}
+
+	if !hasRest {
+		return home, nil
+	}
+	return strings.TrimSuffix(home, "/") + "/" + rest, nil
+}
@@ -0,0 +1,369 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command is a record of the scp protocol sent to a remote scp receiving files, see `Transfer`.
+type Command struct {
+	// Type the kind of record: Create announces a file, Directory enters a directory,
+	// EndDirectory leaves the current directory again and Time sets the times of the file
+	// or directory announced next.
+	Type ResponseType
+
+	// Mode the permissions of the file or directory, for Create and Directory.
+	Mode os.FileMode
+
+	// Size the number of bytes of the contents of the file, for Create.
+	Size int64
+
+	// Name the name of the file or directory, without any directories, for Create and Directory.
+	Name string
+
+	// Mtime the modification time, for Time.
+	Mtime time.Time
+
+	// Atime the access time, for Time. The modification time is used when it is zero.
+	Atime time.Time
+}
+
+// MarshalText formats the command as the record sent to the remote, without the newline
+// ending it, such as "C0644 5 file.txt".
+func (c Command) MarshalText() ([]byte, error) {
+	switch c.Type {
+	case Create, Directory:
+		if !validFilename(c.Name) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidFilename, c.Name)
+		}
+		if c.Size < 0 || (c.Type == Directory && c.Size != 0) {
+			return nil, fmt.Errorf("invalid size %d for %q", c.Size, c.Name)
+		}
+		return []byte(fmt.Sprintf("%c%s %d %s", c.Type, formatPermissions(c.Mode), c.Size, c.Name)), nil
+
+	case EndDirectory:
+		return []byte("E"), nil
+
+	case Time:
+		atime := c.Atime
+		if atime.IsZero() {
+			atime = c.Mtime
+		}
+		return []byte(fmt.Sprintf("T%d 0 %d 0", c.Mtime.Unix(), atime.Unix())), nil
+	}
+
+	return nil, fmt.Errorf("unknown command type %q", c.Type)
+}
+
+// UnmarshalText parses a record sent by a remote scp, such as "C0644 5 file.txt", into the
+// command. The newline ending the record may be included. A record that does not follow the
+// scp protocol results in a ProtocolError.
+func (c *Command) UnmarshalText(text []byte) error {
+	record := string(text)
+	if record == "" {
+		return &ProtocolError{Reason: "empty record", Expected: fileRecordFormat + " or " + timeRecordFormat}
+	}
+
+	switch record[0] {
+	case Create, Directory:
+		return c.unmarshalFile(record)
+
+	case EndDirectory:
+		*c = Command{Type: EndDirectory}
+		return nil
+
+	case Time:
+		// The time is parsed without its response type, as ParseFileTime receives it,
+		// so the error is made to point into the whole record again
+		err := c.unmarshalTime(record[1:])
+		var protocolErr *ProtocolError
+		if errors.As(err, &protocolErr) {
+			protocolErr.Line = record
+			protocolErr.Offset++
+		}
+		return err
+	}
+
+	return &ProtocolError{
+		Reason:   "unknown record type",
+		Line:     record,
+		Expected: fileRecordFormat + " or " + timeRecordFormat,
+	}
+}
+
+// unmarshalFile parses a "C" or "D" record, including its response type.
+func (c *Command) unmarshalFile(record string) error {
+	protocolError := func(reason string, offset int, err error) error {
+		return &ProtocolError{Reason: reason, Line: record, Expected: fileRecordFormat, Offset: offset, Err: err}
+	}
+
+	processRecord := strings.TrimRight(record, "\r\n")
+	parts := strings.SplitN(processRecord, " ", 3)
+	if len(parts) < 3 {
+		return protocolError("missing fields", len(processRecord), nil)
+	}
+
+	permissions, err := strconv.ParseUint(parts[0][1:], 8, 12)
+	if err != nil {
+		return protocolError("unable to parse permissions field", 1, err)
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return protocolError("unable to parse size field", len(parts[0])+1, err)
+	}
+
+	mode, _ := ParsePermissions(fmt.Sprintf("%04o", permissions))
+	*c = Command{Type: record[0], Mode: mode, Size: size, Name: parts[2]}
+	return nil
+}
+
+// unmarshalTime parses a "T" record, without its response type.
+func (c *Command) unmarshalTime(record string) error {
+	protocolError := func(reason string, offset int, err error) error {
+		return &ProtocolError{Reason: reason, Line: record, Expected: timeRecordFormat, Offset: offset, Err: err}
+	}
+
+	processRecord := strings.TrimRight(record, "\r\n")
+	parts := strings.Split(processRecord, " ")
+	if len(parts) < 3 {
+		return protocolError("missing fields", len(processRecord), nil)
+	}
+
+	if len(parts[0]) != 10 {
+		return protocolError("modification time is not 10 digits long", 0, nil)
+	}
+	mtime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return protocolError("unable to parse modification time", 0, err)
+	}
+
+	atimeOffset := len(parts[0]) + len(parts[1]) + 2
+	if len(parts[2]) != 10 {
+		return protocolError("access time is not 10 digits long", atimeOffset, nil)
+	}
+	atime, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return protocolError("unable to parse access time", atimeOffset, err)
+	}
+
+	*c = Command{Type: Time, Mtime: time.Unix(mtime, 0), Atime: time.Unix(atime, 0)}
+	return nil
+}
+
+// Transfer drives a remote scp receiving files record by record, for sequences of files and
+// directories the other methods do not cover. It is started with `BeginUpload`.
+//
+// Every command sent with SendCommand, and every file contents sent with WriteBody, must be
+// followed by ReadResponse to read the confirmation of the remote, before anything else is
+// sent. The transfer must be closed with Close once done.
+type Transfer struct {
+	ctx        context.Context
+	client     *Client
+	remotePath string
+	w          io.WriteCloser
+	stdout     io.Reader
+	stderr     func() string
+	waitRemote func() error
+	cleanup    func()
+
+	// The size of the file announced by the last Create command, until its contents are sent
+	pending int64
+	hasBody bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// BeginUpload starts a remote scp receiving files into `remotePath` recursively, and returns
+// a Transfer to send it the files and directories, once the remote signalled it is ready.
+// Entries announced at the top level are stored in `remotePath` when it is an existing
+// directory, a single file or directory replaces it otherwise.
+//
+// The transfer is aborted as soon as the context is done. `ResponseTimeout` applies to the
+// responses of the remote. A dry run is not supported, as the remote receives whatever
+// is sent.
+func (a *Client) BeginUpload(ctx context.Context, remotePath string, opts ...CallOption) (*Transfer, error) {
+	if a.DryRun {
+		return nil, errors.New("BeginUpload does not support a dry run")
+	}
+
+	remotePath, err := a.expandTilde(ctx, remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.checkRemotePath(remotePath); err != nil {
+		return nil, err
+	}
+
+	if err := a.checkConnection(ctx); err != nil {
+		return nil, err
+	}
+
+	session, closeSession, err := a.openSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating ssh session in begin upload: %w", err)
+	}
+
+	t, err := func() (*Transfer, error) {
+		if err := a.setEnv(session); err != nil {
+			return nil, err
+		}
+
+		stdout, err := session.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		w, err := session.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stderr, err := captureStderr(session)
+		if err != nil {
+			return nil, err
+		}
+
+		waitRemote, err := a.startSCP(session, "-qrt "+quoteShell(remotePath), opts)
+		if err != nil {
+			return nil, err
+		}
+
+		// The remote may be waited for both when it hung up and when closing
+		var waitOnce sync.Once
+		var waitErr error
+		wait := func() error {
+			waitOnce.Do(func() { waitErr = waitRemote() })
+			return waitErr
+		}
+
+		ctx, cancelTimeout := a.transferContext(ctx)
+		ctx, watch, stopWatch := a.watchResponses(ctx)
+		stop := context.AfterFunc(ctx, func() { session.Close() })
+
+		return &Transfer{
+			ctx:        ctx,
+			client:     a,
+			remotePath: remotePath,
+			w:          w,
+			stdout:     watch(stdout),
+			stderr:     stderr,
+			waitRemote: wait,
+			cleanup: func() {
+				stop()
+				stopWatch()
+				cancelTimeout()
+				closeSession()
+			},
+		}, nil
+	}()
+	if err != nil {
+		closeSession()
+		return nil, err
+	}
+
+	// The remote signals that it is ready to receive files
+	if _, err := t.ReadResponse(); err != nil {
+		t.cleanup()
+		return nil, err
+	}
+	return t, nil
+}
+
+// SendCommand sends the command to the remote, read its confirmation with ReadResponse. The
+// contents of a file announced with a Create command must be sent with WriteBody next.
+// `PermissionMask` is applied to the permissions of files and directories, like for every
+// other upload.
+func (t *Transfer) SendCommand(c Command) error {
+	if t.hasBody {
+		return fmt.Errorf("the contents of the file announced before must be sent first")
+	}
+
+	if err := t.client.writeCommand(t.w, c); err != nil {
+		return t.transferError(err)
+	}
+
+	if c.Type == Create {
+		t.pending = c.Size
+		t.hasBody = true
+	}
+	return nil
+}
+
+// WriteBody sends exactly the number of bytes announced by the last Create command from the
+// reader, as the contents of that file, read the confirmation of the remote with ReadResponse.
+// ErrShortRead is returned if the reader runs out before that, in which case the transfer can
+// not be continued.
+func (t *Transfer) WriteBody(r io.Reader) error {
+	if !t.hasBody {
+		return fmt.Errorf("no file was announced with a Create command")
+	}
+	t.hasBody = false
+
+	n, err := t.client.copyContents(t.ctx, pipeWriter{w: t.w}, r, t.pending)
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: expected %d bytes, sent %d", ErrShortRead, t.pending, n)
+	}
+	if err != nil {
+		return t.transferError(err)
+	}
+
+	if _, err := fmt.Fprint(t.w, "\x00"); err != nil {
+		return t.transferError(err)
+	}
+	return nil
+}
+
+// ReadResponse reads the response of the remote to the last command or file contents sent.
+// The error of the remote is returned if it refused them, warnings match ErrRemoteWarning.
+// The remote only sends files when it is the one sending them, so the returned FileInfos
+// are empty.
+func (t *Transfer) ReadResponse() (*FileInfos, error) {
+	fileInfos, err := t.client.parseResponse(t.stdout, t.w, t.remotePath)
+	if err != nil {
+		return fileInfos, t.transferError(err)
+	}
+	return fileInfos, nil
+}
+
+// Close ends the transfer, and waits for the remote to exit. A RemoteError is returned if it
+// failed, such as when it could not store a file. Close is safe to call multiple times.
+func (t *Transfer) Close() error {
+	t.closeOnce.Do(func() {
+		defer t.cleanup()
+
+		t.w.Close()
+		if err := t.waitRemote(); err != nil {
+			t.closeErr = &RemoteError{Err: err, Stderr: t.stderr()}
+		}
+		if t.closeErr != nil && t.ctx.Err() != nil {
+			t.closeErr = context.Cause(t.ctx)
+		}
+	})
+	return t.closeErr
+}
+
+// transferError explains an error of the transfer: the cause of the context when the transfer
+// was aborted, or what the remote reported when it hung up.
+func (t *Transfer) transferError(err error) error {
+	if t.ctx.Err() != nil {
+		return context.Cause(t.ctx)
+	}
+	if hungUp(err) {
+		return hangUpError(err, t.waitRemote(), t.stderr)
+	}
+	return err
+}
@@ -6,20 +6,248 @@
 
 package scp
 
-import "io"
+import (
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"golang.org/x/crypto/ssh"
+)
 
 // CopyN an adaptation of io.CopyN that keeps reading if it did not return
-// a sufficient amount of bytes.
+// a sufficient amount of bytes. On error, the number of bytes copied so far
+// is returned alongside it. If the reader ends before `size` bytes were read,
+// io.ErrUnexpectedEOF is returned.
 func CopyN(writer io.Writer, src io.Reader, size int64) (int64, error) {
+	return copyNBuffer(writer, src, size, nil)
+}
+
+// copyNBuffer is like CopyN, but copies through `buf` when it is not nil instead of
+// letting io.Copy allocate a buffer of its own.
+func copyNBuffer(writer io.Writer, src io.Reader, size int64, buf []byte) (int64, error) {
+	if buf != nil {
+		// Hide io.ReaderFrom and io.WriterTo, which would bypass the buffer
+		writer = struct{ io.Writer }{writer}
+		src = struct{ io.Reader }{src}
+	}
+
 	var total int64
 	total = 0
 	for total < size {
-		n, err := io.CopyN(writer, src, size)
+		n, err := io.CopyBuffer(writer, io.LimitReader(src, size-total), buf)
+		total += n
+		if err == nil && n == 0 {
+			return total, io.ErrUnexpectedEOF
+		}
 		if err != nil {
-			return 0, err
+			return total, err
 		}
-		total += n
 	}
 
 	return total, nil
 }
+
+// copyNContext is like copyNBuffer, but stops copying as soon as the context is done, which
+// is checked before reading every chunk. The cause of the context is returned in that case.
+// A read the remote stalls in is not interrupted, the session must be closed for that.
+func copyNContext(ctx context.Context, writer io.Writer, src io.Reader, size int64, buf []byte) (int64, error) {
+	n, err := copyNBuffer(writer, contextReader{ctx: ctx, r: src}, size, buf)
+	if err != nil && ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+	return n, err
+}
+
+// copyBuffer copies `src` to `writer` until it ends, through a buffer of `bufferSize`
+// bytes when it is positive.
+func copyBuffer(writer io.Writer, src io.Reader, bufferSize int) (int64, error) {
+	if bufferSize <= 0 {
+		return io.Copy(writer, src)
+	}
+	return io.CopyBuffer(struct{ io.Writer }{writer}, struct{ io.Reader }{src}, make([]byte, bufferSize))
+}
+
+// contextReader wraps an io.Reader and stops reading from it as soon as
+// the context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	return r.r.Read(p)
+}
+
+// pipeWriter reports writes to a pipe closed by the remote, which fail with io.EOF,
+// as io.ErrClosedPipe so they can not be mistaken for the end of the input.
+type pipeWriter struct {
+	w io.Writer
+}
+
+func (p pipeWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if err == io.EOF {
+		err = io.ErrClosedPipe
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written to the wrapped writer, so they can be read while
+// another goroutine is still writing.
+type countingWriter struct {
+	w io.Writer
+	n atomic.Int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// remainingSize returns the number of bytes between the current offset of the
+// seeker and its end, leaving the offset unchanged.
+func remainingSize(s io.Seeker) (int64, error) {
+	current, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := s.Seek(current, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return end - current, nil
+}
+
+// readAll reads from the reader until EOF like io.ReadAll, but returns the
+// context's error as soon as it is done, even if the reader is blocked.
+// In that case the blocked read is left to finish in the background.
+func readAll(ctx context.Context, r io.Reader) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	c := make(chan result, 1)
+	go func() {
+		data, err := io.ReadAll(contextReader{ctx: ctx, r: r})
+		c <- result{data: data, err: err}
+	}()
+
+	select {
+	case res := <-c:
+		return res.data, res.err
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CleanRemotePath returns the shortest remote path equivalent to the given one, collapsing
+// repeated slashes and "." and ".." segments. It does not make a relative path absolute, a
+// relative path is still resolved by the remote against the directory the user logs in to.
+func CleanRemotePath(remotePath string) string {
+	return path.Clean(remotePath)
+}
+
+// quoteShell quotes the given string for use as a single argument to a POSIX
+// shell. The string is wrapped in single quotes, and any single quote it
+// contains is escaped by closing the quoted section, emitting an escaped quote
+// and reopening it, so the remote shell passes the string through verbatim.
+func quoteShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// unquotedArgPattern matches the arguments that are passed to a POSIX shell as they are.
+var unquotedArgPattern = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// quoteArgs joins the arguments into a command for a POSIX shell, quoting those that
+// would otherwise be altered by the shell, such as paths with spaces.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = arg
+		if !unquotedArgPattern.MatchString(arg) {
+			quoted[i] = quoteShell(arg)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// quoteGlob quotes the given glob pattern for use as a single argument to a POSIX
+// shell, like `quoteShell`, except for the wildcards "*", "?", "[" and "]" which are
+// left unquoted so the shell still expands the pattern. Within brackets, letters,
+// digits, "!", "^" and "-" are left unquoted as well, so ranges and negations work.
+func quoteGlob(pattern string) string {
+	var b strings.Builder
+	quoted, inBrackets := false, false
+	for _, r := range pattern {
+		unquoted := strings.ContainsRune("*?[]", r) ||
+			inBrackets && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("!^-", r))
+		if unquoted == quoted {
+			b.WriteByte('\'')
+			quoted = !quoted
+		}
+
+		switch r {
+		case '\'':
+			b.WriteString(`'\''`)
+		case '[':
+			inBrackets = true
+			b.WriteRune(r)
+		case ']':
+			inBrackets = false
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if quoted {
+		b.WriteByte('\'')
+	}
+	return b.String()
+}
+
+// maxStderrSize the maximal amount of output kept from the standard error of a remote command.
+const maxStderrSize = 64 * 1024
+
+// captureStderr drains the standard error of the session in the background, so the
+// remote command can never block on it. The returned function waits until the output
+// has been drained and returns it, it must only be called after the session has ended.
+func captureStderr(session *ssh.Session) (func() string, error) {
+	r, err := session.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(&buf, io.LimitReader(r, maxStderrSize))
+		io.Copy(io.Discard, r)
+	}()
+
+	return func() string {
+		<-done
+		return buf.String()
+	}, nil
+}
@@ -0,0 +1,72 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrUnknownVersion is returned by `RemoteSCPVersion` when the version of the remote scp
+// can not be determined, for example because it is not the OpenSSH implementation.
+var ErrUnknownVersion = errors.New("unknown remote scp version")
+
+// openSSHVersionPattern matches the version printed by `ssh -V`, such as "OpenSSH_9.6p1".
+var openSSHVersionPattern = regexp.MustCompile(`OpenSSH_([0-9][0-9A-Za-z.]*)`)
+
+// RemoteSCPVersion returns the version of OpenSSH on the remote, such as "9.6p1", which can
+// be used to find out whether the remote scp supports a feature. The result is cached on
+// the client after the first successful call, until it connects again.
+//
+// OpenSSH scp has no option to print its version, so the version printed by `ssh -V` on
+// the remote is returned instead, as scp is part of the same installation. This requires
+// a remote shell. ErrUnknownVersion is returned if the remote does not have OpenSSH.
+func (a *Client) RemoteSCPVersion(ctx context.Context) (string, error) {
+	sshClient, version := a.cachedVersion()
+	if version != "" {
+		return version, nil
+	}
+
+	output, err := a.runRemote(ctx, "ssh -V 2>&1")
+	if err != nil {
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) {
+			return "", ErrUnknownVersion
+		}
+		return "", err
+	}
+
+	match := openSSHVersionPattern.FindSubmatch(output)
+	if match == nil {
+		return "", ErrUnknownVersion
+	}
+
+	version = string(match[1])
+	if a.connMu != nil {
+		a.connMu.Lock()
+		// The version is only cached for the connection it was found on
+		if a.sshClient == sshClient {
+			a.remoteSCPVersion = version
+		}
+		a.connMu.Unlock()
+	}
+	return version, nil
+}
+
+// cachedVersion returns the current connection, and the version of the remote found on it by
+// `RemoteSCPVersion` if it is known.
+func (a *Client) cachedVersion() (*ssh.Client, string) {
+	if a.connMu == nil {
+		return a.sshClient, a.remoteSCPVersion
+	}
+	a.connMu.RLock()
+	defer a.connMu.RUnlock()
+	return a.sshClient, a.remoteSCPVersion
+}
@@ -0,0 +1,296 @@
+/* Copyright (c) 2024 Bram Vandenbogaerde And Contributors
+ * You may use, distribute or modify this code under the
+ * terms of the Mozilla Public License 2.0, which is distributed
+ * along with the source code.
+ */
+
+package scp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// WalkRemote walks the remote directory tree rooted at `remoteDir`, calling `fn` for every
+// file and directory in it, including `remoteDir` itself. Entries are reported as soon as
+// they are received from the remote, so the tree is never held in memory. A directory is
+// reported before its contents, and the `Path` of every entry is set to its remote path.
+//
+// Walking the tree uses `scp -rf`, so the contents of all files are sent by the remote
+// and discarded. The transfer is aborted as soon as `fn` returns an error.
+// ErrNotDirectory is returned if `remoteDir` is a plain file.
+func (a *Client) WalkRemote(ctx context.Context, remoteDir string, fn func(FileInfos) error, opts ...CallOption) error {
+	return a.receiveTree(ctx, remoteDir, true, func(info FileInfos, body io.Reader) error {
+		return fn(info)
+	}, opts...)
+}
+
+// errStopReceiving is returned by a visit function to stop receiving a tree early
+// without it being reported as an error.
+var errStopReceiving = errors.New("stop receiving")
+
+// StatRemote returns the metadata of the remote file or directory at `remotePath`: its name,
+// permissions, size, modification and access time, and whether it is a directory.
+//
+// The metadata is obtained through scp itself, so no other remote command is needed.
+// The remote starts sending the contents of a file as well, which are discarded.
+func (a *Client) StatRemote(ctx context.Context, remotePath string, opts ...CallOption) (*FileInfos, error) {
+	var fileInfos *FileInfos
+	err := a.receiveTree(ctx, remotePath, false, func(info FileInfos, body io.Reader) error {
+		fileInfos = &info
+		return errStopReceiving
+	}, opts...)
+	if err != nil && err != errStopReceiving {
+		return nil, err
+	}
+	if fileInfos == nil {
+		return nil, fmt.Errorf("no file information received for %q", remotePath)
+	}
+
+	return fileInfos, nil
+}
+
+// receiveTree runs `scp -rf` on the remote directory and calls `visit` for every file and
+// directory it sends. For files, `body` yields the contents of the file, any part of it
+// that is not read by `visit` is discarded. For directories, `body` is nil.
+// When `requireDir` is set, ErrNotDirectory is returned if the remote path is a file.
+func (a *Client) receiveTree(
+	ctx context.Context,
+	remoteDir string,
+	requireDir bool,
+	visit func(info FileInfos, body io.Reader) error,
+	opts ...CallOption,
+) error {
+	remoteDir, err := a.expandTilde(ctx, remoteDir)
+	if err != nil {
+		return err
+	}
+
+	return a.receive(ctx, "-prf "+quoteShell(remoteDir), remoteDir, requireDir, visit, opts...)
+}
+
+// receive runs the remote scp binary with the given arguments, which must make it send
+// files, and calls `visit` for every file and directory it sends like `receiveTree`.
+// The entries sent at the top level get `root` as their path.
+func (a *Client) receive(
+	ctx context.Context,
+	args string,
+	root string,
+	requireDir bool,
+	visit func(info FileInfos, body io.Reader) error,
+	opts ...CallOption,
+) error {
+	if err := a.checkRemotePath(root); err != nil {
+		return err
+	}
+
+	if err := a.checkConnection(ctx); err != nil {
+		return err
+	}
+
+	session, closeSession, err := a.openSession(ctx)
+	if err != nil {
+		return fmt.Errorf("Error creating ssh session in copy from remote: %w", err)
+	}
+	defer closeSession()
+
+	if err := a.setEnv(session); err != nil {
+		return err
+	}
+
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	in, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	stderr, err := captureStderr(session)
+	if err != nil {
+		return err
+	}
+
+	waitRemote, err := a.startSCP(session, args, opts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancelTimeout := a.transferContext(ctx)
+	defer cancelTimeout()
+
+	ctx, watch, stopWatch := a.watchResponses(ctx)
+	defer stopWatch()
+	r = watch(r)
+
+	errCh := make(chan error, 1)
+	go func() {
+		// Stop between the chunks of the bodies as well once the transfer is aborted
+		errCh <- receiveRecords(bufio.NewReader(contextReader{ctx: ctx, r: r}), in, a.protocol(), root, requireDir, a.MaxFileSize, a.warning, visit)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil && !hungUp(err) {
+			return err
+		}
+		// The remote may have exited without a word
+		waitErr := waitRemote()
+		if err == nil && waitErr != nil {
+			err = io.EOF
+		}
+		if err != nil {
+			return hangUpError(err, waitErr, stderr)
+		}
+		return nil
+
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// receiveRecords reads the records sent by a remote `scp -rf` until it is done,
+// acknowledging each of them, and calls `visit` for every file and directory. The records
+// are parsed with `protocol`. Files larger than `maxSize` are refused with ErrFileTooLarge,
+// unless it is zero. Warnings sent instead of an entry are passed to `warning`, the entry is
+// skipped unless it returns an error.
+func receiveRecords(
+	r *bufio.Reader,
+	w io.Writer,
+	protocol Protocol,
+	root string,
+	requireDir bool,
+	maxSize int64,
+	warning func(err error) error,
+	visit func(info FileInfos, body io.Reader) error,
+) error {
+	// The remote paths of the directories we are currently in
+	var dirs []string
+	fileInfos := NewFileInfos()
+
+	if err := Ack(w); err != nil {
+		return err
+	}
+
+	for {
+		responseType, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		message, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		switch responseType {
+		case Warning:
+			if err := warning(remoteWarning(message)); err != nil {
+				return err
+			}
+			// The remote skipped the entry and moves on without waiting for us
+			continue
+
+		case Error:
+			return errors.New(message)
+
+		case Time:
+			if err := protocol.ParseFileTime(message, fileInfos); err != nil {
+				return fmt.Errorf("file %q: %w", entryPath(root, dirs, ""), err)
+			}
+
+		case Create, Directory:
+			if err := protocol.ParseFileInfos(string(responseType)+message, fileInfos); err != nil {
+				return fmt.Errorf("file %q: %w", entryPath(root, dirs, message), err)
+			}
+
+			// Never let the remote place entries outside of the tree
+			name := fileInfos.Filename
+			if name == "" || name == "." || name == ".." || path.Base(name) != name {
+				return fmt.Errorf("invalid file name received from the remote: %q", name)
+			}
+
+			fileInfos.IsDir = responseType == Directory
+			fileInfos.Path = path.Clean(root)
+			if len(dirs) > 0 {
+				fileInfos.Path = path.Join(dirs[len(dirs)-1], name)
+			} else if requireDir && !fileInfos.IsDir {
+				return ErrNotDirectory
+			}
+
+			if fileInfos.IsDir {
+				if err := visit(*fileInfos, nil); err != nil {
+					return err
+				}
+				dirs = append(dirs, fileInfos.Path)
+			} else {
+				if err := checkFileSize(w, fileInfos.Path, fileInfos, maxSize); err != nil {
+					return err
+				}
+
+				if err := Ack(w); err != nil {
+					return err
+				}
+
+				body := io.LimitReader(r, fileInfos.Size)
+				if err := visit(*fileInfos, body); err != nil {
+					return err
+				}
+
+				if _, err := io.Copy(io.Discard, body); err != nil {
+					return err
+				}
+
+				// The remote reports whether it could read the whole file
+				if err := checkResponse(r); err != nil {
+					return err
+				}
+			}
+
+			fileInfos = NewFileInfos()
+
+		case EndDirectory:
+			if len(dirs) == 0 {
+				return errors.New("received end of directory outside of a directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+
+		default:
+			return &ProtocolError{
+				Reason:   "unknown record type",
+				Line:     string(responseType) + message,
+				Expected: fileRecordFormat + " or " + timeRecordFormat + " or E",
+			}
+		}
+
+		if err := Ack(w); err != nil {
+			return err
+		}
+	}
+}
+
+// entryPath returns the remote path of the entry a record is sent for, to name it in errors.
+// The name is taken from the "C" or "D" record in `message` when it has one, otherwise
+// the directory the entry is in is returned.
+func entryPath(root string, dirs []string, message string) string {
+	if len(dirs) == 0 {
+		return path.Clean(root)
+	}
+
+	parts := strings.SplitN(strings.TrimRight(message, "\r\n"), " ", 3)
+	if len(parts) < 3 {
+		return dirs[len(dirs)-1]
+	}
+	return path.Join(dirs[len(dirs)-1], parts[2])
+}